@@ -0,0 +1,436 @@
+package feecalc
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/parser"
+)
+
+// ruleRefs holds the vars a rule assigns and reads
+type ruleRefs struct {
+	assigns []string
+	reads   []string
+}
+
+// identCollector gathers identifiers of an AST, telling function names apart
+// from variable references
+type identCollector struct {
+	idents  []*ast.IdentifierNode
+	callees map[ast.Node]bool
+	assigns []string
+}
+
+func (c *identCollector) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.IdentifierNode:
+		c.idents = append(c.idents, n)
+	case *ast.CallNode:
+		c.callees[n.Callee] = true
+		if callee, ok := n.Callee.(*ast.IdentifierNode); ok && (callee.Value == "Set" || callee.Value == "Accumulate") && len(n.Arguments) > 0 {
+			if name, ok := n.Arguments[0].(*ast.StringNode); ok {
+				c.assigns = append(c.assigns, name.Value)
+			}
+		}
+	}
+}
+
+// envVarCollector gathers the identifiers of a compiled program that resolve
+// to env vars, skipping functions and names the rule has already assigned
+type envVarCollector struct {
+	env      map[string]interface{}
+	assigned map[string]interface{}
+	seen     map[string]bool
+	names    []string
+}
+
+func (c *envVarCollector) Visit(node *ast.Node) {
+	ident, ok := (*node).(*ast.IdentifierNode)
+	if !ok || c.seen[ident.Value] {
+		return
+	}
+	value, inEnv := c.env[ident.Value]
+	if !inEnv || reflect.ValueOf(value).Kind() == reflect.Func {
+		return
+	}
+	if _, ok := c.assigned[ident.Value]; ok {
+		return
+	}
+	c.seen[ident.Value] = true
+	c.names = append(c.names, ident.Value)
+}
+
+// recordDeps compiles a statement of the rule at index against env and adds
+// the env vars it reads to deps. Only Validate and RuleDependencies set deps.
+func (o *exprOptions) recordDeps(index int, stmt string, env, assigned map[string]interface{}, options []expr.Option) {
+	if o.deps == nil || stmt == "" {
+		return
+	}
+	program, err := compileExpression(stmt, env, options...)
+	if err != nil {
+		return
+	}
+	c := &envVarCollector{env: env, assigned: assigned, seen: make(map[string]bool)}
+	for _, name := range o.deps[index] {
+		c.seen[name] = true
+	}
+	node := program.Node()
+	ast.Walk(&node, c)
+	o.deps[index] = append(o.deps[index], c.names...)
+}
+
+// parseRule parses each statement of a rule, skipping notes and statements
+// that fail to parse
+func parseRule(rule string) []ast.Node {
+	if isNote(rule) {
+		return nil
+	}
+	var nodes []ast.Node
+	for _, stmt := range preprocessStatements(rule) {
+		tree, err := parser.Parse(strings.TrimSpace(stmt))
+		if err != nil {
+			continue
+		}
+		nodes = append(nodes, tree.Node)
+	}
+	return nodes
+}
+
+// analyzeRule parses a rule and returns the vars it assigns and reads.
+// Rules that fail to parse report whatever statements could be parsed.
+func analyzeRule(rule string) ruleRefs {
+	var refs ruleRefs
+	seenAssign := make(map[string]bool)
+	seenRead := make(map[string]bool)
+	for _, node := range parseRule(rule) {
+		c := &identCollector{callees: make(map[ast.Node]bool)}
+		ast.Walk(&node, c)
+		for _, name := range c.assigns {
+			if !seenAssign[name] {
+				seenAssign[name] = true
+				refs.assigns = append(refs.assigns, name)
+			}
+		}
+		for _, ident := range c.idents {
+			if c.callees[ident] || seenRead[ident.Value] {
+				continue
+			}
+			seenRead[ident.Value] = true
+			refs.reads = append(refs.reads, ident.Value)
+		}
+	}
+	return refs
+}
+
+// AnalyzeDependencies returns (producer, consumer) rule index pairs where the
+// producer assigns a var that the consumer reads. Pairs with producer >
+// consumer point at rules reading a var before it is assigned. Pairs are
+// sorted by producer, then consumer.
+func (e *FeeEngine) AnalyzeDependencies() [][2]int {
+	refs := make([]ruleRefs, len(e.rules))
+	for i, r := range e.rules {
+		refs[i] = analyzeRule(r.expr)
+	}
+
+	pairs := make([][2]int, 0)
+	for p := range refs {
+		for c := range refs {
+			if p == c || !sharesVar(refs[p].assigns, refs[c].reads) {
+				continue
+			}
+			pairs = append(pairs, [2]int{p, c})
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] != pairs[j][0] {
+			return pairs[i][0] < pairs[j][0]
+		}
+		return pairs[i][1] < pairs[j][1]
+	})
+	return pairs
+}
+
+// ToDOT renders the rules as a Graphviz DOT graph: one node per rule,
+// labeled with its index and name (or expression), and an edge from each rule
+// that assigns a var to each rule that reads it, labeled with the vars. Edges
+// pointing back to an earlier rule, i.e. a var read before it is assigned,
+// are dashed.
+func (e *FeeEngine) ToDOT() string {
+	refs := make([]ruleRefs, len(e.rules))
+	for i, r := range e.rules {
+		refs[i] = analyzeRule(r.expr)
+	}
+
+	var b strings.Builder
+	b.WriteString("digraph rules {\n")
+	b.WriteString("  node [shape=box];\n")
+	for i, r := range e.rules {
+		label := r.name
+		if label == "" {
+			label = r.expr
+		}
+		fmt.Fprintf(&b, "  r%d [label=%s];\n", i, dotQuote(fmt.Sprintf("%d: %s", i, label)))
+	}
+	for _, pair := range e.AnalyzeDependencies() {
+		var shared []string
+		for _, name := range refs[pair[0]].assigns {
+			for _, read := range refs[pair[1]].reads {
+				if name == read {
+					shared = append(shared, name)
+				}
+			}
+		}
+		style := ""
+		if pair[0] > pair[1] {
+			style = ", style=dashed"
+		}
+		fmt.Fprintf(&b, "  r%d -> r%d [label=%s%s];\n", pair[0], pair[1], dotQuote(strings.Join(shared, ", ")), style)
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// dotQuote quotes s as a DOT string
+func dotQuote(s string) string {
+	s = strings.ReplaceAll(s, `\`, `\\`)
+	s = strings.ReplaceAll(s, `"`, `\"`)
+	s = strings.ReplaceAll(s, "\n", `\n`)
+	return `"` + s + `"`
+}
+
+// sharesVar reports whether any name appears in both lists
+func sharesVar(a, b []string) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// RuleDependencies returns the env vars the compiled rule at index reads,
+// sorted. They are collected while dry-running the rules as Validate does, so
+// only names that resolve to vars are reported: functions, string contents,
+// member names (the x in cfg.x) and vars the rule assigned before reading
+// them are not. Rules that are disabled, not reached or fail to compile
+// report what was collected, possibly nothing. Out-of-range indexes return nil.
+func (e *FeeEngine) RuleDependencies(index int) []string {
+	if index < 0 || index >= len(e.rules) {
+		return nil
+	}
+	deps, _ := e.dryRun()
+	sorted := append([]string{}, deps[index]...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// currencyArgs maps fee-producing helpers to the position of their currency argument
+var currencyArgs = map[string]int{"$": 1, "TaggedFee": 1, "Split": 1, "BucketFee": 1, "SpreadFee": 3}
+
+// currencyCollector gathers the currency arguments of fee-producing calls
+type currencyCollector struct {
+	vars       map[string]interface{}
+	currencies map[Currency]bool
+	defaulted  bool
+}
+
+func (c *currencyCollector) Visit(node *ast.Node) {
+	call, ok := (*node).(*ast.CallNode)
+	if !ok {
+		return
+	}
+	callee, ok := call.Callee.(*ast.IdentifierNode)
+	if !ok {
+		return
+	}
+	pos, ok := currencyArgs[callee.Value]
+	if !ok {
+		return
+	}
+	if pos >= len(call.Arguments) {
+		c.defaulted = true
+		return
+	}
+	switch arg := call.Arguments[pos].(type) {
+	case *ast.StringNode:
+		c.currencies[normalizeCurrency(arg.Value)] = true
+	case *ast.IdentifierNode:
+		if s, ok := c.vars[arg.Value].(string); ok {
+			c.currencies[normalizeCurrency(s)] = true
+		}
+	}
+}
+
+// Currencies predicts the currencies the rules produce fees in, sorted. It is
+// a best-effort scan of currency string literals passed to $, TaggedFee,
+// Split, BucketFee and SpreadFee, currency vars set on the context and the
+// default currency; currencies computed at run time are missed.
+func (e *FeeEngine) Currencies() []string {
+	e.ctx.mu.RLock()
+	c := &currencyCollector{vars: e.ctx.Vars, currencies: make(map[Currency]bool)}
+	for _, r := range e.rules {
+		for _, node := range parseRule(r.expr) {
+			ast.Walk(&node, c)
+		}
+	}
+	e.ctx.mu.RUnlock()
+
+	if c.defaulted && e.opts.defaultCurrency != "" {
+		c.currencies[normalizeCurrency(e.opts.defaultCurrency)] = true
+	}
+
+	currencies := make([]string, 0, len(c.currencies))
+	for currency := range c.currencies {
+		currencies = append(currencies, string(currency))
+	}
+	sort.Strings(currencies)
+	return currencies
+}
+
+// Lint warning categories
+const (
+	LintMagnitude = "magnitude"
+	LintOrder     = "order"
+	LintFeeAmount = "fee-amount"
+)
+
+// LintWarning is a likely mistake found in a rule
+type LintWarning struct {
+	Index    int    `json:"index"`
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// Lint scans the rules for common mistakes without executing them:
+//   - magnitude: a literal above 1 multiplying the base amount or assigned
+//     to a rate var, which looks like a percent used as a fraction
+//   - order: a var read before the rule that assigns it, unless it is
+//     already set on the context or is a constant
+//   - fee-amount: $ called with a string or boolean literal amount
+func (e *FeeEngine) Lint() []LintWarning {
+	warnings := make([]LintWarning, 0)
+
+	refs := make([]ruleRefs, len(e.rules))
+	for i, r := range e.rules {
+		refs[i] = analyzeRule(r.expr)
+		for _, node := range parseRule(r.expr) {
+			v := &lintVisitor{index: i, base: e.opts.base()}
+			ast.Walk(&node, v)
+			warnings = append(warnings, v.warnings...)
+		}
+	}
+
+	firstAssign := make(map[string]int)
+	for i, r := range refs {
+		for _, name := range r.assigns {
+			if _, ok := firstAssign[name]; !ok {
+				firstAssign[name] = i
+			}
+		}
+	}
+	e.ctx.mu.RLock()
+	for i, r := range refs {
+		for _, name := range r.reads {
+			at, ok := firstAssign[name]
+			if !ok || at <= i {
+				continue
+			}
+			if _, ok := e.ctx.Vars[name]; ok {
+				continue
+			}
+			if _, ok := e.opts.constants[name]; ok {
+				continue
+			}
+			warnings = append(warnings, LintWarning{
+				Index:    i,
+				Category: LintOrder,
+				Message:  fmt.Sprintf("%s is read before rule %d assigns it", name, at),
+			})
+		}
+	}
+	e.ctx.mu.RUnlock()
+
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return warnings[i].Index < warnings[j].Index
+	})
+	return warnings
+}
+
+// lintVisitor applies the per-node lint heuristics to one statement
+type lintVisitor struct {
+	index    int
+	base     string
+	warnings []LintWarning
+}
+
+func (v *lintVisitor) Visit(node *ast.Node) {
+	switch n := (*node).(type) {
+	case *ast.BinaryNode:
+		if n.Operator != "*" {
+			return
+		}
+		if lit, ok := numberLiteral(n.Right); ok && isIdent(n.Left, v.base) {
+			v.checkRate(lit, v.base+" * ")
+		} else if lit, ok := numberLiteral(n.Left); ok && isIdent(n.Right, v.base) {
+			v.checkRate(lit, v.base+" * ")
+		}
+	case *ast.CallNode:
+		callee, ok := n.Callee.(*ast.IdentifierNode)
+		if !ok || len(n.Arguments) == 0 {
+			return
+		}
+		switch callee.Value {
+		case "Set":
+			name, ok := n.Arguments[0].(*ast.StringNode)
+			if !ok || len(n.Arguments) < 2 || !strings.Contains(strings.ToLower(name.Value), "rate") {
+				return
+			}
+			if lit, ok := numberLiteral(n.Arguments[1]); ok {
+				v.checkRate(lit, name.Value+" = ")
+			}
+		case "$":
+			switch n.Arguments[0].(type) {
+			case *ast.StringNode, *ast.BoolNode:
+				v.warnings = append(v.warnings, LintWarning{
+					Index:    v.index,
+					Category: LintFeeAmount,
+					Message:  "$ called with a non-numeric amount",
+				})
+			}
+		}
+	}
+}
+
+// checkRate warns when a rate literal looks like a percent
+func (v *lintVisitor) checkRate(rate float64, context string) {
+	if rate > 1 && rate <= 100 {
+		v.warnings = append(v.warnings, LintWarning{
+			Index:    v.index,
+			Category: LintMagnitude,
+			Message:  fmt.Sprintf("%s%v looks like a percent used as a fraction", context, rate),
+		})
+	}
+}
+
+// numberLiteral returns the value of an integer or float literal node
+func numberLiteral(node ast.Node) (float64, bool) {
+	switch n := node.(type) {
+	case *ast.IntegerNode:
+		return float64(n.Value), true
+	case *ast.FloatNode:
+		return n.Value, true
+	}
+	return 0, false
+}
+
+// isIdent reports whether node is an identifier with the given name
+func isIdent(node ast.Node, name string) bool {
+	ident, ok := node.(*ast.IdentifierNode)
+	return ok && ident.Value == name
+}
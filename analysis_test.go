@@ -0,0 +1,166 @@
+package feecalc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAnalysis_Dependencies(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(
+		`x = amount * 0.01`,
+		`$(amount * 0.02, "USD")`,
+		`$(x, "USD")`,
+	)
+
+	pairs := engine.AnalyzeDependencies()
+
+	if len(pairs) != 1 {
+		t.Fatalf("Expected 1 dependency pair, got %v", pairs)
+	}
+
+	if pairs[0] != [2]int{0, 2} {
+		t.Errorf("Expected pair (0, 2), got %v", pairs[0])
+	}
+}
+
+func TestAnalysis_DependenciesOutOfOrder(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(
+		`$(total_fee, "USD")`,
+		`total_fee = fiat_fee + network_fee`,
+		`fiat_fee = 10`,
+	)
+
+	pairs := engine.AnalyzeDependencies()
+
+	expected := [][2]int{{1, 0}, {2, 1}}
+	if len(pairs) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, pairs)
+	}
+	for i := range expected {
+		if pairs[i] != expected[i] {
+			t.Errorf("Expected pair %v, got %v", expected[i], pairs[i])
+		}
+	}
+}
+
+func TestAnalysis_RuleDependencies(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{
+		"amount":   100.0,
+		"rate":     0.01,
+		"currency": "USD",
+		"unused":   1.0,
+	}}).WithConfig(map[string]interface{}{"base": 2.0})
+	engine.AddRule(
+		`$(amount*rate,"USD")`,
+		`fee = Add(cfg.base, "rate"); $(fee, currency)`,
+		`amount = amount * 2`,
+	)
+
+	cases := []struct {
+		index    int
+		expected []string
+	}{
+		{0, []string{"amount", "rate"}},
+		// fee is assigned by the rule itself, and "rate" is a string
+		{1, []string{"cfg", "currency"}},
+		// amount is read before the rule assigns it
+		{2, []string{"amount"}},
+		{3, nil},
+	}
+	for _, c := range cases {
+		deps := engine.RuleDependencies(c.index)
+		if !reflect.DeepEqual(deps, c.expected) {
+			t.Errorf("Rule %d: expected dependencies %v, got %v", c.index, c.expected, deps)
+		}
+	}
+}
+
+func TestAnalysis_ToDOT(t *testing.T) {
+	engine := New(nil)
+	engine.AddNamedRule("platform rate", `x = amount * 0.01`)
+	engine.AddRule(
+		`$(amount * 0.02, "USD")`,
+		`$(x, "USD")`,
+	)
+
+	dot := engine.ToDOT()
+
+	for _, want := range []string{
+		"digraph rules {",
+		`r0 [label="0: platform rate"];`,
+		`r2 [label="2: $(x, \"USD\")"];`,
+		`r0 -> r2 [label="x"];`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("Expected DOT output to contain %s, got:\n%s", want, dot)
+		}
+	}
+
+	if strings.Contains(dot, "r1 ->") || strings.Contains(dot, "-> r1") {
+		t.Errorf("Expected no edges for rule 1, got:\n%s", dot)
+	}
+}
+
+func TestAnalysis_Lint(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"amount": 1000.0}})
+	engine.AddRule(
+		`$(amount * 2.5, "USD")`,
+		`$(total_fee, "USD")`,
+		`total_fee = amount * 0.01`,
+		`$("10", "USD")`,
+		`fiat_rate = 3; $(amount * fiat_rate, "USD")`,
+		`$(amount * 0.02, "USD")`,
+	)
+
+	warnings := engine.Lint()
+
+	expected := []struct {
+		index    int
+		category string
+	}{
+		{0, LintMagnitude},
+		{1, LintOrder},
+		{3, LintFeeAmount},
+		{4, LintMagnitude},
+	}
+	if len(warnings) != len(expected) {
+		t.Fatalf("Expected %d lint warnings, got %+v", len(expected), warnings)
+	}
+	for i, want := range expected {
+		if warnings[i].Index != want.index || warnings[i].Category != want.category {
+			t.Errorf("Expected warning %d to be %s at rule %d, got %+v", i, want.category, want.index, warnings[i])
+		}
+		if warnings[i].Message == "" {
+			t.Errorf("Expected warning %d to have a message", i)
+		}
+	}
+}
+
+func TestAnalysis_Currencies(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{
+		"amount":          1000.0,
+		"settle_currency": "eur",
+	}})
+	engine.AddRule(
+		`$(amount * 0.01, "USD")`,
+		`[$(2.0, "usd"), $(1.0, settle_currency)]`,
+		`amount > 500 ? $(amount * 0.001, "EUR") : nil`,
+		`# $(1.0, "GBP")`,
+		`SpreadFee(amount, 0.0099, 0.0101, "kes")`,
+	)
+
+	currencies := engine.Currencies()
+
+	expected := []string{"EUR", "KES", "USD"}
+	if len(currencies) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, currencies)
+	}
+	for i := range expected {
+		if currencies[i] != expected[i] {
+			t.Errorf("Expected %v, got %v", expected, currencies)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package feecalc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/shopspring/decimal"
+)
+
+// Currency is an upper-case currency code such as "USD" or "USDT".
+// It encodes to JSON as a plain string.
+type Currency string
+
+// NewCurrency normalizes and validates a currency code: surrounding spaces are
+// trimmed, letters are upper-cased, and the result must be 2 to 10 letters or
+// digits
+func NewCurrency(s string) (Currency, error) {
+	c := normalizeCurrency(s)
+	if len(c) < 2 || len(c) > 10 {
+		return "", fmt.Errorf("invalid currency code %q", s)
+	}
+	for _, r := range c {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') {
+			return "", fmt.Errorf("invalid currency code %q", s)
+		}
+	}
+	return c, nil
+}
+
+// normalizeCurrency trims and upper-cases a currency code without validating it
+func normalizeCurrency(s string) Currency {
+	return Currency(strings.ToUpper(strings.TrimSpace(s)))
+}
+
+// CurrencyInfo describes a currency for rounding and formatting
+type CurrencyInfo struct {
+	// MinorUnits is the number of decimal places of the smallest unit,
+	// e.g. 2 for USD cents
+	MinorUnits int32  `json:"minor_units"`
+	Symbol     string `json:"symbol,omitempty"`
+	Name       string `json:"name,omitempty"`
+}
+
+// defaultCurrencyTable lists common currencies; WithCurrencyTable adds to or
+// overrides it
+var defaultCurrencyTable = map[Currency]CurrencyInfo{
+	"USD":  {MinorUnits: 2, Symbol: "$", Name: "US Dollar"},
+	"EUR":  {MinorUnits: 2, Symbol: "€", Name: "Euro"},
+	"GBP":  {MinorUnits: 2, Symbol: "£", Name: "Pound Sterling"},
+	"JPY":  {MinorUnits: 0, Symbol: "¥", Name: "Japanese Yen"},
+	"KES":  {MinorUnits: 2, Symbol: "KSh", Name: "Kenyan Shilling"},
+	"NGN":  {MinorUnits: 2, Symbol: "₦", Name: "Nigerian Naira"},
+	"USDT": {MinorUnits: 6, Name: "Tether"},
+	"BTC":  {MinorUnits: 8, Symbol: "₿", Name: "Bitcoin"},
+}
+
+// WithCurrencyTable registers currency metadata used by WithCurrencyRounding
+// and FormatFee, on top of a default table of common currencies
+func (e *FeeEngine) WithCurrencyTable(table map[string]CurrencyInfo) *FeeEngine {
+	if e.currencyTable == nil {
+		e.currencyTable = make(map[Currency]CurrencyInfo, len(table))
+	}
+	for code, info := range table {
+		e.currencyTable[normalizeCurrency(code)] = info
+	}
+	e.opts.currencies = e.currencyTable
+	return e
+}
+
+// LookupCurrency returns the metadata for a currency from the engine's table
+// or the default table
+func (e *FeeEngine) LookupCurrency(code string) (CurrencyInfo, bool) {
+	return lookupCurrency(e.currencyTable, code)
+}
+
+func lookupCurrency(table map[Currency]CurrencyInfo, code string) (CurrencyInfo, bool) {
+	c := normalizeCurrency(code)
+	if info, ok := table[c]; ok {
+		return info, true
+	}
+	info, ok := defaultCurrencyTable[c]
+	return info, ok
+}
+
+// WithCurrencyRounding rounds result fee items and summary lines to each
+// currency's minor units, using fallback places for currencies missing from
+// the currency table
+func (e *FeeEngine) WithCurrencyRounding(fallback int32) *FeeEngine {
+	e.rounding = true
+	e.roundPlaces = fallback
+	e.currencyRounding = true
+	return e
+}
+
+// roundingPlaces returns the decimal places fee items in currency round to
+func (e *FeeEngine) roundingPlaces(currency Currency) int32 {
+	if e.currencyRounding {
+		if info, ok := e.LookupCurrency(string(currency)); ok {
+			return info.MinorUnits
+		}
+	}
+	return e.roundPlaces
+}
+
+// FormatFee formats a fee item with its currency symbol and minor units, e.g.
+// "$12.50". Currencies without a symbol are written as "12.50 USDC", and
+// currencies missing from the table keep their amount as is.
+func (e *FeeEngine) FormatFee(item FeeItem) string {
+	return formatFee(item, e.currencyTable, numberFormat{decimal: "."})
+}
+
+// numberFormat holds the separators and symbol placement of a locale
+type numberFormat struct {
+	group       string
+	decimal     string
+	symbolAfter bool
+}
+
+// localeFormats maps language codes to their number format
+var localeFormats = map[string]numberFormat{
+	"en": {group: ",", decimal: "."},
+	"ja": {group: ",", decimal: "."},
+	"zh": {group: ",", decimal: "."},
+	"de": {group: ".", decimal: ",", symbolAfter: true},
+	"es": {group: ".", decimal: ",", symbolAfter: true},
+	"it": {group: ".", decimal: ",", symbolAfter: true},
+	"id": {group: ".", decimal: ","},
+	"fr": {group: " ", decimal: ",", symbolAfter: true},
+}
+
+// localeFormat returns the number format for a locale such as "de-DE" or
+// "fr_FR", matched by language. Unknown locales format like FormatFee.
+func localeFormat(locale string) numberFormat {
+	lang, _, _ := strings.Cut(strings.ReplaceAll(locale, "_", "-"), "-")
+	lang = strings.ToLower(lang)
+	if f, ok := localeFormats[lang]; ok {
+		return f
+	}
+	return numberFormat{decimal: "."}
+}
+
+func formatFee(item FeeItem, table map[Currency]CurrencyInfo, f numberFormat) string {
+	info, ok := lookupCurrency(table, string(item.Currency))
+	if !ok {
+		return fmt.Sprintf("%s %s", f.number(item.Amount.String()), item.Currency)
+	}
+	amount := f.number(item.Amount.StringFixed(info.MinorUnits))
+	switch {
+	case info.Symbol == "":
+		return fmt.Sprintf("%s %s", amount, item.Currency)
+	case f.symbolAfter:
+		return amount + " " + info.Symbol
+	case strings.HasPrefix(amount, "-"):
+		return "-" + info.Symbol + amount[1:]
+	}
+	return info.Symbol + amount
+}
+
+// number rewrites a plain decimal string with the format's separators
+func (f numberFormat) number(s string) string {
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if f.group != "" {
+		var b strings.Builder
+		for i, r := range whole {
+			if i > 0 && (len(whole)-i)%3 == 0 {
+				b.WriteString(f.group)
+			}
+			b.WriteRune(r)
+		}
+		whole = b.String()
+	}
+	if hasFrac {
+		return sign + whole + f.decimal + frac
+	}
+	return sign + whole
+}
+
+// InvoiceRow is a fee item ready to render as an invoice line
+type InvoiceRow struct {
+	Description string            `json:"description"`
+	Amount      decimal.Decimal   `json:"amount"`
+	Currency    Currency          `json:"currency"`
+	Formatted   string            `json:"formatted"`
+	Tags        map[string]string `json:"tags,omitempty"`
+}
+
+// InvoiceRows turns the fee items into invoice rows in order, formatting
+// amounts with the currency table the engine had and the separators of locale,
+// e.g. "en-US" or "de-DE". The description is the item's label, else its
+// "description" tag, else "Fee".
+func (r *ExecuteResult) InvoiceRows(locale string) []InvoiceRow {
+	f := localeFormat(locale)
+	rows := make([]InvoiceRow, len(r.FeeItems))
+	for i, item := range r.FeeItems {
+		description := item.Label
+		if description == "" {
+			description = item.Tags["description"]
+		}
+		if description == "" {
+			description = "Fee"
+		}
+		rows[i] = InvoiceRow{
+			Description: description,
+			Amount:      item.Amount,
+			Currency:    item.Currency,
+			Formatted:   formatFee(item, r.currencies, f),
+			Tags:        item.Tags,
+		}
+	}
+	return rows
+}
+
+// Rate quotes how many units of Quote one unit of Base is worth, e.g. Base USD,
+// Quote KES, Mid 130.
+//
+// Conversions apply the side of the spread that works against the converted
+// amount: Base to Quote multiplies by the bid, Quote to Base divides by the
+// ask. Bid and Ask are used when set; otherwise they are derived from Mid as
+// Mid × (1 − Spread) and Mid × (1 + Spread). With neither set, Mid is used for
+// both directions.
+type Rate struct {
+	Base  Currency
+	Quote Currency
+	Mid   decimal.Decimal
+	// Bid and Ask override the spread-derived sides when non-zero
+	Bid decimal.Decimal
+	Ask decimal.Decimal
+	// Spread is the fraction of Mid applied to each side, e.g. 0.01 for 1%
+	Spread decimal.Decimal
+}
+
+func (r Rate) bid() decimal.Decimal {
+	if !r.Bid.IsZero() {
+		return r.Bid
+	}
+	return r.Mid.Mul(decimal.NewFromInt(1).Sub(r.Spread))
+}
+
+func (r Rate) ask() decimal.Decimal {
+	if !r.Ask.IsZero() {
+		return r.Ask
+	}
+	return r.Mid.Mul(decimal.NewFromInt(1).Add(r.Spread))
+}
+
+// rateTable indexes rates by their (base, quote) pair
+type rateTable map[[2]Currency]Rate
+
+// convert converts amount between currencies using a direct or inverse rate
+func (t rateTable) convert(amount decimal.Decimal, from, to Currency) (decimal.Decimal, error) {
+	if from == to {
+		return amount, nil
+	}
+	if r, ok := t[[2]Currency{from, to}]; ok {
+		return amount.Mul(r.bid()), nil
+	}
+	if r, ok := t[[2]Currency{to, from}]; ok {
+		ask := r.ask()
+		if ask.IsZero() {
+			return decimal.Zero, fmt.Errorf("zero rate for %s/%s", to, from)
+		}
+		return amount.Div(ask), nil
+	}
+	return decimal.Zero, fmt.Errorf("no rate to convert %s to %s", from, to)
+}
+
+// WithRates adds exchange rates used by Convert, SummaryIn and the Convert
+// rule helper. A rate also serves the inverse conversion.
+func (e *FeeEngine) WithRates(rates ...Rate) *FeeEngine {
+	if e.opts.rates == nil {
+		e.opts.rates = make(rateTable, len(rates))
+	}
+	for _, r := range rates {
+		r.Base = normalizeCurrency(string(r.Base))
+		r.Quote = normalizeCurrency(string(r.Quote))
+		e.opts.rates[[2]Currency{r.Base, r.Quote}] = r
+	}
+	return e
+}
+
+// Convert converts amount from one currency to another using the engine's rates
+func (e *FeeEngine) Convert(amount decimal.Decimal, from, to string) (decimal.Decimal, error) {
+	return e.opts.rates.convert(amount, normalizeCurrency(from), normalizeCurrency(to))
+}
+
+// SummaryIn returns the total of all summary lines converted to currency using
+// the rates the engine had when the result was built
+func (r *ExecuteResult) SummaryIn(currency string) (decimal.Decimal, error) {
+	target := normalizeCurrency(currency)
+	total := decimal.Zero
+	for _, item := range r.Summary {
+		converted, err := r.rates.convert(item.Amount, item.Currency, target)
+		if err != nil {
+			return decimal.Zero, err
+		}
+		total = total.Add(converted)
+	}
+	return total, nil
+}
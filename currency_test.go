@@ -0,0 +1,252 @@
+package feecalc
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestCurrency_MixedCaseSummary(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(100, "usd")`, `$(100, "USD")`, `$(50, " Usd ")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.Summary) != 1 {
+		t.Fatalf("Expected 1 summary line, got %d", len(result.Summary))
+	}
+
+	if result.Summary[0].Currency != "USD" {
+		t.Errorf("Expected currency USD, got %s", result.Summary[0].Currency)
+	}
+
+	if !result.Summary[0].Amount.Equal(decimal.NewFromInt(250)) {
+		t.Errorf("Expected USD summary 250, got %s", result.Summary[0].Amount.String())
+	}
+
+	data, err := json.Marshal(result.Summary[0])
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	if string(data) != `{"amount":"250","currency":"USD"}` {
+		t.Errorf("Expected currency as plain JSON string, got %s", data)
+	}
+}
+
+func TestCurrency_NewCurrency(t *testing.T) {
+	c, err := NewCurrency(" usdt ")
+	if err != nil {
+		t.Fatalf("NewCurrency failed: %v", err)
+	}
+	if c != "USDT" {
+		t.Errorf("Expected USDT, got %s", c)
+	}
+
+	for _, invalid := range []string{"", "U", "US-D", "TOOLONGCURRENCY"} {
+		if _, err := NewCurrency(invalid); err == nil {
+			t.Errorf("Expected error for %q, but got nil", invalid)
+		}
+	}
+}
+
+func TestCurrency_ConvertWithSpread(t *testing.T) {
+	engine := New(nil).WithRates(
+		Rate{Base: "USD", Quote: "kes", Mid: decimal.NewFromInt(130), Spread: decimal.RequireFromString("0.01")},
+	)
+	mid := New(nil).WithRates(Rate{Base: "USD", Quote: "KES", Mid: decimal.NewFromInt(130)})
+
+	amount := decimal.NewFromInt(1300)
+	spreadUSD, err := engine.Convert(amount, "KES", "USD")
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	midUSD, err := mid.Convert(amount, "KES", "USD")
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+
+	if !midUSD.Equal(decimal.NewFromInt(10)) {
+		t.Errorf("Expected mid-rate figure 10, got %s", midUSD.String())
+	}
+
+	// KES -> USD divides by the ask, 130 * 1.01 = 131.3
+	if !spreadUSD.Equal(amount.Div(decimal.RequireFromString("131.3"))) {
+		t.Errorf("Expected 1300 / 131.3, got %s", spreadUSD.String())
+	}
+	if !spreadUSD.LessThan(midUSD) {
+		t.Errorf("Expected spread-adjusted %s to be below mid-rate %s", spreadUSD.String(), midUSD.String())
+	}
+
+	// USD -> KES multiplies by the bid, 130 * 0.99 = 128.7
+	kes, err := engine.Convert(decimal.NewFromInt(10), "USD", "KES")
+	if err != nil {
+		t.Fatalf("Convert failed: %v", err)
+	}
+	if !kes.Equal(decimal.NewFromInt(1287)) {
+		t.Errorf("Expected 1287 KES, got %s", kes.String())
+	}
+
+	if _, err := engine.Convert(amount, "KES", "EUR"); err == nil {
+		t.Error("Expected error for missing rate, but got nil")
+	}
+}
+
+func TestCurrency_SummaryIn(t *testing.T) {
+	engine := New(nil).WithRates(
+		Rate{Base: "USD", Quote: "KES", Mid: decimal.NewFromInt(130), Bid: decimal.NewFromInt(128), Ask: decimal.NewFromInt(130)},
+	)
+	engine.AddRule(`[$(1300.0, "KES"), $(5.0, "USD")]`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	total, err := result.SummaryIn("USD")
+	if err != nil {
+		t.Fatalf("SummaryIn failed: %v", err)
+	}
+
+	if !total.Equal(decimal.NewFromInt(15)) {
+		t.Errorf("Expected 15 USD, got %s", total.String())
+	}
+}
+
+func TestCurrency_CurrencyTable(t *testing.T) {
+	engine := New(nil).
+		WithCurrencyTable(map[string]CurrencyInfo{
+			"xtk": {MinorUnits: 4, Symbol: "T", Name: "Test Token"},
+		}).
+		WithCurrencyRounding(2)
+	engine.AddRule(`[$(1.234567, "XTK"), $(1.234567, "USD"), $(1.234567, "JPY"), $(1.234567, "ABC")]`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	expected := map[Currency]string{"XTK": "1.2346", "USD": "1.23", "JPY": "1", "ABC": "1.23"}
+	for currency, want := range expected {
+		if got := findAmountByCurrency(result.FeeItems, currency); !got.Equal(decimal.RequireFromString(want)) {
+			t.Errorf("Expected %s rounded to %s, got %s", currency, want, got.String())
+		}
+	}
+
+	formatted := engine.FormatFee(FeeItem{Amount: decimal.RequireFromString("-1.5"), Currency: "XTK"})
+	if formatted != "-T1.5000" {
+		t.Errorf("Expected -T1.5000, got %s", formatted)
+	}
+
+	if formatted := engine.FormatFee(FeeItem{Amount: decimal.RequireFromString("2"), Currency: "USDT"}); formatted != "2.000000 USDT" {
+		t.Errorf("Expected 2.000000 USDT, got %s", formatted)
+	}
+
+	info, ok := engine.LookupCurrency("xtk")
+	if !ok || info.Name != "Test Token" {
+		t.Errorf("Expected custom currency info, got %+v (ok=%v)", info, ok)
+	}
+}
+
+func TestCurrency_InvoiceRows(t *testing.T) {
+	engine := New(nil).SetVar("amount", 123456.0)
+	engine.AddRule(
+		`TaggedFee(amount * 0.01, "EUR", {"description": "Processing fee"})`,
+		`$(-2.5, "USD")`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	cases := map[string][]string{
+		"en-US": {"€1,234.56", "-$2.50"},
+		"de_DE": {"1.234,56 €", "-2,50 $"},
+		"":      {"€1234.56", "-$2.50"},
+	}
+	for locale, expected := range cases {
+		rows := result.InvoiceRows(locale)
+		if len(rows) != 2 {
+			t.Fatalf("Expected 2 rows, got %d", len(rows))
+		}
+		for i, row := range rows {
+			if row.Formatted != expected[i] {
+				t.Errorf("Locale %q row %d: expected %s, got %s", locale, i, expected[i], row.Formatted)
+			}
+		}
+	}
+
+	rows := result.InvoiceRows("en")
+	if rows[0].Description != "Processing fee" || rows[1].Description != "Fee" {
+		t.Errorf("Unexpected descriptions: %q, %q", rows[0].Description, rows[1].Description)
+	}
+
+	if rows[1].Currency != "USD" || !rows[1].Amount.Equal(decimal.RequireFromString("-2.5")) {
+		t.Errorf("Expected -2.5 USD on the second row, got %s %s", rows[1].Amount.String(), rows[1].Currency)
+	}
+}
+
+func TestCurrency_BankRound(t *testing.T) {
+	cases := []struct {
+		amount   string
+		currency string
+		expected string
+	}{
+		{"2.345", "USD", "2.34"},
+		{"2.355", "usd", "2.36"},
+		{"2.5", "USD", "2.5"},
+		{"2.345", "JPY", "2"},
+		{"2.5", "JPY", "2"},
+		{"3.5", "JPY", "4"},
+		{"1.23456", "XTK", "1.2346"},
+	}
+
+	table := map[string]CurrencyInfo{"XTK": {MinorUnits: 4}}
+	for _, c := range cases {
+		engine := New(nil).
+			WithCurrencyTable(table).
+			SetVar("amount", decimal.RequireFromString(c.amount)).
+			SetVar("currency", c.currency)
+		engine.AddRule(`$(BankRound(amount, currency), currency)`)
+
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+
+		if got := result.FeeItems[0].Amount; !got.Equal(decimal.RequireFromString(c.expected)) {
+			t.Errorf("BankRound(%s, %s): expected %s, got %s", c.amount, c.currency, c.expected, got.String())
+		}
+	}
+
+	engine := New(nil)
+	engine.AddRule(`$(BankRound(1.5, "ZZZ"), "USD")`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "unknown currency") {
+		t.Errorf("Expected unknown currency error, got %v", err)
+	}
+}
+
+func TestCurrency_SpreadFee(t *testing.T) {
+	engine := New(nil).SetVar("amount", 10000.0)
+	engine.AddRule(`SpreadFee(amount, 0.0099, 0.0101, "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(2)) {
+		t.Errorf("Expected spread fee 2 USD, got %s", amount.String())
+	}
+
+	engine = New(nil).SetVar("amount", 10000.0)
+	engine.AddRule(`SpreadFee(amount, 0.0101, 0.0099, "USD")`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "below buy rate") {
+		t.Errorf("Expected inverted spread error, got %v", err)
+	}
+}
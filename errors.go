@@ -0,0 +1,112 @@
+package feecalc
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/expr-lang/expr/file"
+)
+
+// ErrInvalidCount is returned when ExecuteN is called with a non-positive count
+var ErrInvalidCount = errors.New("count must be positive")
+
+// ErrNoRules is returned when executing an engine that has no rules. It wraps
+// ErrInvalidCount and keeps its message, which is what executing an empty
+// engine returned before ErrNoRules was added.
+var ErrNoRules = fmt.Errorf("%w", ErrInvalidCount)
+
+// ErrAlreadyExecuted is returned by Execute when all rules have already run
+// and the guard set with WithGuardDoubleExecute is on
+var ErrAlreadyExecuted = errors.New("rules already executed: call Reset before executing again")
+
+// ErrMaxFeeItems is returned when a rule would push the fee item count past
+// the limit set with WithMaxFeeItems
+var ErrMaxFeeItems = errors.New("fee item limit exceeded")
+
+// ErrNonFinite is returned when a NaN or infinite float is used as a var or fee amount
+var ErrNonFinite = errors.New("non-finite number")
+
+// CompileError reports a rule that failed to compile
+type CompileError struct {
+	Index        int
+	Rule         string
+	Preprocessed string
+	Err          error
+}
+
+func (e *CompileError) Error() string {
+	if e.Preprocessed != "" && e.Preprocessed != e.Rule {
+		return fmt.Sprintf("failed to compile expression (preprocessed: %s): %v", e.Preprocessed, e.Err)
+	}
+	return fmt.Sprintf("failed to compile expression: %v", e.Err)
+}
+
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// RuntimeError reports a rule that compiled but failed while running
+type RuntimeError struct {
+	Index        int
+	Rule         string
+	Preprocessed string
+	Err          error
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Preprocessed != "" && e.Preprocessed != e.Rule {
+		return fmt.Sprintf("failed to execute expression (preprocessed: %s): %v", e.Preprocessed, e.Err)
+	}
+	return fmt.Sprintf("failed to execute expression: %v", e.Err)
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// MissingVarError reports a rule referencing a variable that is not defined
+type MissingVarError struct {
+	Name string
+	err  error
+}
+
+func (e *MissingVarError) Error() string {
+	if e.err != nil {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("unknown name %s", e.Name)
+}
+
+func (e *MissingVarError) Unwrap() error {
+	return e.err
+}
+
+// newCompileError wraps an expr compile error, detecting unknown names
+func newCompileError(err error) *CompileError {
+	var fe *file.Error
+	if errors.As(err, &fe) && strings.HasPrefix(fe.Message, "unknown name ") {
+		err = &MissingVarError{
+			Name: strings.TrimPrefix(fe.Message, "unknown name "),
+			err:  err,
+		}
+	}
+	return &CompileError{Index: -1, Err: err}
+}
+
+// withRule records the rule index, text and preprocessed form on typed rule errors
+func withRule(err error, index int, rule string) error {
+	var ce *CompileError
+	if errors.As(err, &ce) {
+		ce.Index = index
+		ce.Rule = rule
+		ce.Preprocessed = preprocessExpression(rule)
+	}
+	var re *RuntimeError
+	if errors.As(err, &re) {
+		re.Index = index
+		re.Rule = rule
+		re.Preprocessed = preprocessExpression(rule)
+	}
+	return err
+}
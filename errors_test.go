@@ -0,0 +1,117 @@
+package feecalc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestErrors_CompileErrorIndex(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(10.0, "USD")`)
+	engine.AddRule(`$(10.0 +, "USD")`)
+
+	_, err := engine.Execute()
+	if err == nil {
+		t.Fatal("Expected compile error, but got nil")
+	}
+
+	var ce *CompileError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Expected CompileError, got %T: %v", err, err)
+	}
+
+	if ce.Index != 1 {
+		t.Errorf("Expected rule index 1, got %d", ce.Index)
+	}
+
+	if ce.Rule != `$(10.0 +, "USD")` {
+		t.Errorf("Expected failing rule text, got %s", ce.Rule)
+	}
+
+	if !strings.HasPrefix(err.Error(), "error executing rule at index 1: failed to compile expression:") {
+		t.Errorf("Unexpected error message: %v", err)
+	}
+}
+
+func TestErrors_MissingVar(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 1000.0,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx)
+	engine.AddRule(`$(amount * rate, "USD")`)
+
+	_, err := engine.Execute()
+
+	var mv *MissingVarError
+	if !errors.As(err, &mv) {
+		t.Fatalf("Expected MissingVarError, got %T: %v", err, err)
+	}
+
+	if mv.Name != "rate" {
+		t.Errorf("Expected missing var rate, got %s", mv.Name)
+	}
+}
+
+func TestErrors_RuntimeError(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"items": []interface{}{1, 2},
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx)
+	engine.AddRule(`$(items[5], "USD")`)
+
+	_, err := engine.Execute()
+
+	var re *RuntimeError
+	if !errors.As(err, &re) {
+		t.Fatalf("Expected RuntimeError, got %T: %v", err, err)
+	}
+
+	if re.Index != 0 {
+		t.Errorf("Expected rule index 0, got %d", re.Index)
+	}
+}
+
+func TestErrors_Sentinels(t *testing.T) {
+	engine := New(nil)
+
+	_, err := engine.Execute()
+	if !errors.Is(err, ErrNoRules) {
+		t.Errorf("Expected ErrNoRules, got %v", err)
+	}
+	// Executing an empty engine reported a non-positive count before ErrNoRules
+	if !errors.Is(err, ErrInvalidCount) || err.Error() != "count must be positive" {
+		t.Errorf("Expected the backward compatible count error, got %v", err)
+	}
+
+	engine.AddRule(`$(10.0, "USD")`)
+	if _, err := engine.ExecuteN(0); !errors.Is(err, ErrInvalidCount) {
+		t.Errorf("Expected ErrInvalidCount, got %v", err)
+	}
+}
+
+func TestErrors_PreprocessedInMessage(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`a = b*2`)
+
+	_, err := engine.Execute()
+
+	var ce *CompileError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Expected CompileError, got %T: %v", err, err)
+	}
+
+	if ce.Preprocessed != `Set("a", b*2)` {
+		t.Errorf("Expected preprocessed form on error, got %s", ce.Preprocessed)
+	}
+
+	if !strings.Contains(err.Error(), `Set("a", b*2)`) {
+		t.Errorf("Expected preprocessed form in message, got %v", err)
+	}
+}
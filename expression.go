@@ -2,61 +2,95 @@ package feecalc
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/vm"
 	"github.com/shopspring/decimal"
 )
 
 // newFeeItem creates a new fee item
-// amount can be float64, int, string, or decimal.Decimal
-func newFeeItem(amount interface{}, currency string) FeeItem {
-	var d decimal.Decimal
-	switch v := amount.(type) {
-	case decimal.Decimal:
-		d = v
+// amount can be any value accepted by toDecimal, including decimal.Decimal
+// currency is normalized, so "usd" and "USD" summarize together
+func newFeeItem(amount interface{}, currency string) (FeeItem, error) {
+	if err := checkFinite(amount); err != nil {
+		return FeeItem{}, fmt.Errorf("fee amount: %w", err)
+	}
+	return FeeItem{
+		Amount:   toDecimal(amount),
+		Currency: normalizeCurrency(currency),
+	}, nil
+}
+
+// checkFinite rejects NaN and infinite floats, which decimal cannot represent
+func checkFinite(v interface{}) error {
+	var f float64
+	switch val := v.(type) {
 	case float64:
-		d = decimal.NewFromFloat(v)
-	case int:
-		d = decimal.NewFromInt(int64(v))
-	case int64:
-		d = decimal.NewFromInt(v)
-	case string:
-		var err error
-		d, err = decimal.NewFromString(v)
-		if err != nil {
-			d = decimal.Zero
-		}
+		f = val
+	case float32:
+		f = float64(val)
 	default:
-		d = decimal.Zero
+		return nil
 	}
-	return FeeItem{
-		Amount:   d,
-		Currency: currency,
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return fmt.Errorf("%w: %v", ErrNonFinite, f)
 	}
+	return nil
 }
 
 // executeSingleExpression executes a single expression string
-func executeSingleExpression(exprStr string, env map[string]interface{}) (interface{}, error) {
+func executeSingleExpression(exprStr string, env map[string]interface{}, options ...expr.Option) (interface{}, error) {
 	if exprStr == "" {
 		return nil, nil
 	}
 
-	program, err := expr.Compile(exprStr, expr.Env(env))
+	program, err := compileExpression(exprStr, env, options...)
 	if err != nil {
-		return nil, fmt.Errorf("failed to compile expression: %w", err)
+		return nil, err
 	}
 
 	output, err := expr.Run(program, env)
 	if err != nil {
-		return nil, fmt.Errorf("failed to execute expression: %w", err)
+		return nil, &RuntimeError{Index: -1, Err: err}
 	}
 
 	return output, nil
 }
 
+// compileExpression compiles a single expression against env
+func compileExpression(exprStr string, env map[string]interface{}, options ...expr.Option) (*vm.Program, error) {
+	program, err := expr.Compile(exprStr, append([]expr.Option{expr.Env(env)}, options...)...)
+	if err != nil {
+		return nil, newCompileError(err)
+	}
+	return program, nil
+}
+
+// checkResultType rejects rules whose result type can never produce fee
+// items, such as a comparison returning bool
+func checkResultType(program *vm.Program) error {
+	t := program.Node().Type()
+	if t == nil || t == reflect.TypeOf(FeeItem{}) || t == reflect.TypeOf(returnValue{}) {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Interface, reflect.Slice, reflect.Array:
+		return nil
+	}
+	return fmt.Errorf("rule returns %s, expected a fee item, an array or nil", t)
+}
+
 // extractExpressionStrings extracts expression strings from output
+// Nested arrays of strings are flattened in order
 func extractExpressionStrings(output interface{}) []string {
 	if arr, ok := output.([]string); ok {
 		return arr
@@ -65,9 +99,16 @@ func extractExpressionStrings(output interface{}) []string {
 	if arr, ok := output.([]interface{}); ok && len(arr) > 0 {
 		expressions := make([]string, 0, len(arr))
 		for _, item := range arr {
-			if str, ok := item.(string); ok {
-				expressions = append(expressions, str)
-			} else {
+			switch v := item.(type) {
+			case string:
+				expressions = append(expressions, v)
+			case []string, []interface{}:
+				nested := extractExpressionStrings(v)
+				if nested == nil {
+					return nil // Nested array is not all strings
+				}
+				expressions = append(expressions, nested...)
+			default:
 				return nil // Not all strings, return nil
 			}
 		}
@@ -77,6 +118,33 @@ func extractExpressionStrings(output interface{}) []string {
 	return nil
 }
 
+// defaultMaxExprDepth bounds expression arrays evaluating to further
+// expression arrays unless set with WithMaxExprDepth
+const defaultMaxExprDepth = 16
+
+// executeExpressionArray runs each expression and collects its fee items.
+// Expressions that evaluate to another expression array are run in turn,
+// at most depth levels deep.
+func executeExpressionArray(exprs []string, env map[string]interface{}, depth int, feeItems *[]FeeItem, options ...expr.Option) error {
+	if depth <= 0 {
+		return &RuntimeError{Index: -1, Err: fmt.Errorf("expression arrays nested too deep")}
+	}
+	for _, subExpr := range exprs {
+		output, err := executeSingleExpression(subExpr, env, options...)
+		if err != nil {
+			return err
+		}
+		if nested := extractExpressionStrings(output); len(nested) > 0 {
+			if err := executeExpressionArray(nested, env, depth-1, feeItems, options...); err != nil {
+				return err
+			}
+			continue
+		}
+		extractFeeItems(output, feeItems)
+	}
+	return nil
+}
+
 // extractFeeItems extracts FeeItems from output and appends to the slice
 func extractFeeItems(output interface{}, feeItems *[]FeeItem) {
 	if output == nil {
@@ -97,11 +165,373 @@ func extractFeeItems(output interface{}, feeItems *[]FeeItem) {
 	}
 }
 
-// toDecimal converts various numeric types to decimal.Decimal
+// splitFee splits an amount into labeled fee items by weights summing to 1.
+// Shares are rounded to the amount's precision (at least 2 places) and any
+// rounding residual goes to the largest share, ties broken by label order.
+func splitFee(amount interface{}, currency string, shares map[string]interface{}) ([]interface{}, error) {
+	if len(shares) == 0 {
+		return nil, fmt.Errorf("split requires at least one share")
+	}
+
+	total := toDecimal(amount)
+	labels := make([]string, 0, len(shares))
+	weightSum := decimal.Zero
+	for label, w := range shares {
+		labels = append(labels, label)
+		weightSum = weightSum.Add(toDecimal(w))
+	}
+	sort.Strings(labels)
+	if weightSum.Sub(decimal.NewFromInt(1)).Abs().GreaterThan(decimal.New(1, -6)) {
+		return nil, fmt.Errorf("split weights must sum to 1, got %s", weightSum.String())
+	}
+
+	places := -total.Exponent()
+	if places < 2 {
+		places = 2
+	}
+
+	items := make([]interface{}, len(labels))
+	allocated := decimal.Zero
+	largest := 0
+	for i, label := range labels {
+		weight := toDecimal(shares[label])
+		if weight.GreaterThan(toDecimal(shares[labels[largest]])) {
+			largest = i
+		}
+		share := total.Mul(weight).Round(places)
+		allocated = allocated.Add(share)
+		items[i] = FeeItem{Amount: share, Currency: normalizeCurrency(currency), Label: label}
+	}
+
+	if residual := total.Sub(allocated); !residual.IsZero() {
+		item := items[largest].(FeeItem)
+		item.Amount = item.Amount.Add(residual)
+		items[largest] = item
+	}
+	return items, nil
+}
+
+// caseOf returns the result paired with the first true condition, or def if
+// none match. def may be nil to produce no fee.
+func caseOf(conditions []interface{}, results []interface{}, def interface{}) (interface{}, error) {
+	if len(conditions) != len(results) {
+		return nil, fmt.Errorf("case requires as many results as conditions, got %d and %d", len(results), len(conditions))
+	}
+	for i, c := range conditions {
+		matched, ok := c.(bool)
+		if !ok {
+			return nil, fmt.Errorf("case condition %d is not a boolean: %v", i, c)
+		}
+		if matched {
+			return results[i], nil
+		}
+	}
+	return def, nil
+}
+
+// currencyArg accepts a currency given as a string or a Currency, e.g. from
+// a var holding either
+func currencyArg(v interface{}) (string, error) {
+	switch c := v.(type) {
+	case string:
+		return c, nil
+	case Currency:
+		return string(c), nil
+	}
+	return "", fmt.Errorf("currency must be a string, got %T", v)
+}
+
+// tierCapped sums the fee over banded brackets of [threshold, rate, cap],
+// sorted by threshold. Each bracket's band runs from its threshold to the
+// next one and contributes min(band*rate, cap); a missing or nil cap means
+// no cap.
+func tierCapped(amount interface{}, brackets []interface{}) (decimal.Decimal, error) {
+	value := toDecimal(amount)
+	thresholds := make([]decimal.Decimal, len(brackets))
+	for i, b := range brackets {
+		bracket, ok := b.([]interface{})
+		if !ok || len(bracket) < 2 || len(bracket) > 3 {
+			return decimal.Zero, fmt.Errorf("tier bracket %d must be [threshold, rate] or [threshold, rate, cap]", i)
+		}
+		thresholds[i] = toDecimal(bracket[0])
+		if i > 0 && thresholds[i].LessThan(thresholds[i-1]) {
+			return decimal.Zero, fmt.Errorf("tier thresholds must be ascending, bracket %d is below bracket %d", i, i-1)
+		}
+	}
+
+	total := decimal.Zero
+	for i, b := range brackets {
+		if !value.GreaterThan(thresholds[i]) {
+			break
+		}
+		upper := value
+		if i+1 < len(brackets) && thresholds[i+1].LessThan(value) {
+			upper = thresholds[i+1]
+		}
+		bracket := b.([]interface{})
+		fee := upper.Sub(thresholds[i]).Mul(toDecimal(bracket[1]))
+		if len(bracket) == 3 && bracket[2] != nil && fee.GreaterThan(toDecimal(bracket[2])) {
+			fee = toDecimal(bracket[2])
+		}
+		total = total.Add(fee)
+	}
+	return total, nil
+}
+
+// toDecimals converts an array of numbers, e.g. []interface{} or []float64,
+// to decimals
+func toDecimals(v interface{}) ([]decimal.Decimal, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return nil, fmt.Errorf("expected an array, got %T", v)
+	}
+	out := make([]decimal.Decimal, rv.Len())
+	for i := range out {
+		elem := rv.Index(i).Interface()
+		if !isNumeric(elem) {
+			return nil, fmt.Errorf("array element %d is not a number: %v (%T)", i, elem, elem)
+		}
+		out[i] = toDecimal(elem)
+	}
+	return out, nil
+}
+
+// roundMode rounds d to places decimal places with the given mode
+func roundMode(d decimal.Decimal, places int32, mode RoundingMode) decimal.Decimal {
+	switch mode {
+	case RoundHalfEven:
+		return d.RoundBank(places)
+	case RoundDown:
+		return d.RoundDown(places)
+	case RoundUp:
+		return d.RoundUp(places)
+	case RoundCeiling:
+		return d.RoundCeil(places)
+	case RoundFloor:
+		return d.RoundFloor(places)
+	default:
+		return d.Round(places)
+	}
+}
+
+// divInt divides a by b rounding the quotient to an integer towards positive
+// (ceil) or negative (floor) infinity
+func divInt(a, b decimal.Decimal, ceil bool) (decimal.Decimal, error) {
+	if b.IsZero() {
+		return decimal.Zero, fmt.Errorf("division by zero")
+	}
+	q, r := a.QuoRem(b, 0)
+	if r.IsZero() {
+		return q, nil
+	}
+	positive := a.Sign() == b.Sign()
+	if ceil && positive {
+		return q.Add(decimal.NewFromInt(1)), nil
+	}
+	if !ceil && !positive {
+		return q.Sub(decimal.NewFromInt(1)), nil
+	}
+	return q, nil
+}
+
+// randPick picks one of items with probability proportional to its weight
+func randPick(rng *rand.Rand, items []interface{}, weights []interface{}) (interface{}, error) {
+	if len(items) == 0 || len(items) != len(weights) {
+		return nil, fmt.Errorf("rand pick requires matching non-empty items and weights, got %d and %d", len(items), len(weights))
+	}
+	total := 0.0
+	for i, w := range weights {
+		f := toDecimal(w).InexactFloat64()
+		if f < 0 {
+			return nil, fmt.Errorf("rand pick weight %d is negative", i)
+		}
+		total += f
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("rand pick weights sum to zero")
+	}
+	r := rng.Float64() * total
+	for i, w := range weights {
+		r -= toDecimal(w).InexactFloat64()
+		if r < 0 {
+			return items[i], nil
+		}
+	}
+	return items[len(items)-1], nil
+}
+
+// taxInclusive returns the tax contained in gross at the given rate,
+// gross - gross/(1+rate)
+func taxInclusive(gross, rate decimal.Decimal) (decimal.Decimal, error) {
+	divisor := decimal.NewFromInt(1).Add(rate)
+	if divisor.IsZero() {
+		return decimal.Zero, fmt.Errorf("tax rate cannot be -1")
+	}
+	return gross.Sub(gross.Div(divisor)), nil
+}
+
+// grossUp returns the gross amount that leaves net after a proportional fee
+// at rate, net/(1-rate)
+func grossUp(net, rate decimal.Decimal) (decimal.Decimal, error) {
+	if rate.GreaterThanOrEqual(decimal.NewFromInt(1)) {
+		return decimal.Zero, fmt.Errorf("gross-up rate must be below 1, got %s", rate.String())
+	}
+	return net.Div(decimal.NewFromInt(1).Sub(rate)), nil
+}
+
+// isDiscarded reports whether a rule result is neither nil, a fee item nor an
+// array, so the engine ignores it
+func isDiscarded(output interface{}) bool {
+	if output == nil {
+		return false
+	}
+	if _, ok := output.(FeeItem); ok {
+		return false
+	}
+	switch reflect.TypeOf(output).Kind() {
+	case reflect.Slice, reflect.Array:
+		return false
+	}
+	return true
+}
+
+// returnValue marks the value of a return directive, which ends a
+// multi-statement rule early
+type returnValue struct {
+	value interface{}
+}
+
+// rewriteReturn turns each `return X` in a statement into a Return(X) call.
+// X extends to the end of the statement, or to the ':' of an enclosing
+// ternary or the bracket closing the enclosing group, so
+// `cond ? return $(1, "USD") : nil` becomes `cond ? Return($(1, "USD")) : nil`.
+func rewriteReturn(stmt string) string {
+	var quote byte
+	for i := 0; i < len(stmt); i++ {
+		c := stmt[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if c == '"' || c == '\'' || c == '`' {
+			quote = c
+			continue
+		}
+		if !strings.HasPrefix(stmt[i:], "return") || (i > 0 && isIdentByte(stmt[i-1])) {
+			continue
+		}
+		start := i + len("return")
+		if start < len(stmt) && isIdentByte(stmt[start]) {
+			continue
+		}
+		end := returnOperandEnd(stmt, start)
+		operand := strings.TrimSpace(stmt[start:end])
+		rest := stmt[end:]
+		sep := ""
+		if strings.HasPrefix(rest, ":") {
+			sep = " "
+		}
+		return stmt[:i] + "Return(" + operand + ")" + sep + rewriteReturn(rest)
+	}
+	return stmt
+}
+
+// returnOperandEnd finds where the operand of a return starting at start ends
+func returnOperandEnd(stmt string, start int) int {
+	var quote byte
+	depth := 0
+	for i := start; i < len(stmt); i++ {
+		c := stmt[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		case ':':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return len(stmt)
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// templatePattern matches {{param}} placeholders in rule templates
+var templatePattern = regexp.MustCompile(`\{\{\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*\}\}`)
+
+// expandTemplate replaces {{param}} placeholders with values from params
+func expandTemplate(rule string, params map[string]string) (string, error) {
+	var missing []string
+	expanded := templatePattern.ReplaceAllStringFunc(rule, func(m string) string {
+		name := templatePattern.FindStringSubmatch(m)[1]
+		value, ok := params[name]
+		if !ok {
+			missing = append(missing, name)
+			return m
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("missing template params: %s", strings.Join(missing, ", "))
+	}
+	return expanded, nil
+}
+
+// isNumeric reports whether v is a number toDecimal converts by value
+func isNumeric(v interface{}) bool {
+	switch v.(type) {
+	case decimal.Decimal, *decimal.Decimal, float64, float32,
+		int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return true
+	}
+	return false
+}
+
+// isDecimal reports whether v holds a decimal.Decimal or a pointer to one
+func isDecimal(v interface{}) bool {
+	switch v.(type) {
+	case decimal.Decimal, *decimal.Decimal:
+		return true
+	}
+	return false
+}
+
+// toDecimal converts various numeric types to decimal.Decimal. Like strings
+// that do not parse, NaN and infinite floats convert to zero rather than
+// panicking; callers that must tell them apart use checkFinite first.
 func toDecimal(v interface{}) decimal.Decimal {
+	if checkFinite(v) != nil {
+		return decimal.Zero
+	}
 	switch val := v.(type) {
 	case decimal.Decimal:
 		return val
+	case *decimal.Decimal:
+		if val == nil {
+			return decimal.Zero
+		}
+		return *val
 	case float64:
 		return decimal.NewFromFloat(val)
 	case float32:
@@ -117,7 +547,7 @@ func toDecimal(v interface{}) decimal.Decimal {
 	case int64:
 		return decimal.NewFromInt(val)
 	case uint:
-		return decimal.NewFromInt(int64(val))
+		return decimal.RequireFromString(strconv.FormatUint(uint64(val), 10))
 	case uint8:
 		return decimal.NewFromInt(int64(val))
 	case uint16:
@@ -126,7 +556,7 @@ func toDecimal(v interface{}) decimal.Decimal {
 		return decimal.NewFromInt(int64(val))
 	case uint64:
 		// uint64 might overflow int64, convert via string to be safe
-		return decimal.NewFromInt(int64(val))
+		return decimal.RequireFromString(strconv.FormatUint(val, 10))
 	case string:
 		d, err := decimal.NewFromString(val)
 		if err != nil {
@@ -138,22 +568,42 @@ func toDecimal(v interface{}) decimal.Decimal {
 	}
 }
 
+// isNote reports whether a rule is a documentation-only note
+func isNote(exprStr string) bool {
+	return strings.HasPrefix(strings.TrimSpace(exprStr), "#")
+}
+
 // preprocessExpression converts assignment syntax (var = value) to Set calls
 // Examples:
 //   - "amount = 123" -> "Set(\"amount\", 123)"
 //   - "amount = 123; rate = 0.02" -> "Set(\"amount\", 123); Set(\"rate\", 0.02)"
 //   - "amount = 123; $(amount * rate, \"USD\")" -> "Set(\"amount\", 123); $(amount * rate, \"USD\")"
+//
+// Newlines outside brackets and string literals are treated as statement
+// separators, so multi-line rules behave like their semicolon-separated
+// equivalent. A line that ends with an operator, or is followed by one that
+// starts with one, continues the current statement instead.
 func preprocessExpression(exprStr string) string {
+	return strings.Join(preprocessStatements(exprStr), "; ")
+}
+
+// preprocessStatements splits a rule into statements and converts assignments
+// to Set calls, see preprocessExpression. Callers that run or parse the
+// statements use the slice directly, since a joined statement list cannot be
+// split again safely once string literals contain "; ".
+func preprocessStatements(exprStr string) []string {
 	if exprStr == "" {
-		return exprStr
+		return []string{exprStr}
 	}
 
 	// Pattern to match variable assignments: identifier = expression
-	// Match: word characters = (rest of the line until semicolon or end)
-	assignmentPattern := regexp.MustCompile(`\b([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*(.+)$`)
+	// Match: a statement starting with word characters = (rest of the statement).
+	// Anchored so that comparisons (a == b) and "=" inside string literals,
+	// e.g. Repeat(2, "a = a * 2"), are left alone.
+	assignmentPattern := regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)\s*=([^=].*)$`)
 
-	// Split by semicolon to handle multiple statements
-	parts := strings.Split(exprStr, ";")
+	// Split by semicolon or newline to handle multiple statements
+	parts := splitStatements(exprStr)
 	var processedParts []string
 
 	for _, part := range parts {
@@ -175,20 +625,290 @@ func preprocessExpression(exprStr string) string {
 	}
 
 	if len(processedParts) == 0 {
-		return exprStr
+		return []string{exprStr}
 	}
+	return processedParts
+}
 
-	// If we have multiple parts, we need to execute them in sequence
-	// Since expr doesn't support multiple statements, we'll need to handle this differently
-	// For now, if there are multiple parts, we'll execute them as separate expressions
-	// But we need to modify executeExpression to handle this
-	if len(processedParts) > 1 {
-		// Return as array of expressions to execute sequentially
-		// This will be handled in executeExpression
-		return strings.Join(processedParts, "; ")
+// continuationChars are the characters that, at the end of a line or the start
+// of the next one, mark a wrapped expression rather than a new statement
+const continuationChars = "+-*/%?:&|=<>,."
+
+// splitStatements splits a rule on semicolons and on newlines that are not
+// inside brackets or string literals and do not wrap an operator
+func splitStatements(exprStr string) []string {
+	var parts []string
+	var current strings.Builder
+	depth := 0
+	var quote rune
+	escaped := false
+
+	runes := []rune(exprStr)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		if quote != 0 {
+			current.WriteRune(r)
+			switch {
+			case escaped:
+				escaped = false
+			case r == '\\' && quote != '`':
+				escaped = true
+			case r == quote:
+				quote = 0
+			}
+			continue
+		}
+
+		switch r {
+		case '"', '\'', '`':
+			quote = r
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			if depth > 0 {
+				depth--
+			}
+		case ';':
+			parts = append(parts, current.String())
+			current.Reset()
+			continue
+		case '\n', '\r':
+			line := strings.TrimSpace(current.String())
+			next := strings.TrimLeft(string(runes[i+1:]), " \t\r\n")
+			wrapped := depth > 0 ||
+				(line != "" && strings.ContainsRune(continuationChars, rune(line[len(line)-1]))) ||
+				(next != "" && strings.ContainsRune(continuationChars, rune(next[0])))
+			if wrapped {
+				current.WriteRune(' ')
+			} else {
+				parts = append(parts, current.String())
+				current.Reset()
+			}
+			continue
+		}
+		current.WriteRune(r)
 	}
+	parts = append(parts, current.String())
+	return parts
+}
+
+// macro is a rule-level function whose body is a DSL expression
+type macro struct {
+	params []string
+	body   string
+}
+
+// configKey is the reserved name rules use to read the WithConfig object
+const configKey = "cfg"
+
+// exprOptions carries engine configuration into expression evaluation
+type exprOptions struct {
+	// constants are merged into the env on top of context vars
+	constants map[string]interface{}
+	// config is exposed to rules as cfg, see WithConfig
+	config interface{}
+	// baseVar names the var holding the transacting amount, "amount" by default
+	baseVar string
+	// reversing is set while the engine runs rules in reverse
+	reversing bool
+	// funcs are user functions registered with RegisterFunc
+	funcs map[string]interface{}
+	// sandbox restricts the functions available to rules
+	sandbox *SandboxOptions
+	// defaultCurrency is used by the one-argument form of $
+	defaultCurrency string
+	// rng backs Rand and RandPick; created lazily with a time seed unless seeded
+	rng *rand.Rand
+	// warnAsError makes Warn fail the rule instead of recording a warning
+	warnAsError bool
+	// rates are exchange rates set with WithRates
+	rates rateTable
+	// clock backs the time-of-day helpers; time.Now when nil
+	clock func() time.Time
+	// checkTypes rejects rules whose result type cannot produce fee items
+	checkTypes bool
+	// strictNoOp fails rules whose result is discarded without any effect
+	strictNoOp bool
+	// prorateUnclamped lets Prorate use fractions outside [0, 1]
+	prorateUnclamped bool
+	// divPrecision is the number of places Div rounds to; zero uses the
+	// decimal package default
+	divPrecision int32
+	// roundingMode is the mode Round and Quantize use
+	roundingMode RoundingMode
+	// currencies is the engine's currency table, see WithCurrencyTable
+	currencies map[Currency]CurrencyInfo
+	// maxExprDepth bounds nested expression arrays; zero uses the default
+	maxExprDepth int
+	// macros are DSL functions defined with DefineMacro
+	macros map[string]macro
+	// deps, when set, collects the env vars each rule's compiled statements
+	// read, keyed by rule index; see RuleDependencies
+	deps map[int][]string
+}
 
-	return processedParts[0]
+// random returns the random source, creating a time-seeded one if needed
+func (o *exprOptions) random() *rand.Rand {
+	if o.rng == nil {
+		o.rng = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return o.rng
+}
+
+// now returns the current time from the configured clock
+func (o *exprOptions) now() time.Time {
+	if o.clock == nil {
+		return time.Now()
+	}
+	return o.clock()
+}
+
+// compileOptions returns extra expr compile options for the configuration
+func (o *exprOptions) compileOptions() []expr.Option {
+	options := o.decimalOperators()
+	if o.sandbox == nil {
+		return options
+	}
+	if !o.sandbox.AllowBuiltins {
+		options = append(options, expr.DisableAllBuiltins())
+	}
+	if o.sandbox.MaxNodes > 0 {
+		options = append(options, expr.MaxNodes(o.sandbox.MaxNodes))
+	}
+	return options
+}
+
+// decimalOperators overloads the arithmetic and comparison operators and
+// unary minus for decimal.Decimal operands, so decimal vars can be used with
+// + - * / and compared without going through Add, Sub, Mul and Div. Operands
+// of other types keep the builtin operators.
+func (o *exprOptions) decimalOperators() []expr.Option {
+	arithmetic := []interface{}{
+		new(func(decimal.Decimal, decimal.Decimal) decimal.Decimal),
+		new(func(decimal.Decimal, float64) decimal.Decimal),
+		new(func(float64, decimal.Decimal) decimal.Decimal),
+		new(func(decimal.Decimal, int) decimal.Decimal),
+		new(func(int, decimal.Decimal) decimal.Decimal),
+	}
+	comparison := []interface{}{
+		new(func(decimal.Decimal, decimal.Decimal) bool),
+		new(func(decimal.Decimal, float64) bool),
+		new(func(float64, decimal.Decimal) bool),
+		new(func(decimal.Decimal, int) bool),
+		new(func(int, decimal.Decimal) bool),
+	}
+	binary := func(fn func(a, b decimal.Decimal) (interface{}, error)) func(params ...interface{}) (interface{}, error) {
+		return func(params ...interface{}) (interface{}, error) {
+			return fn(toDecimal(params[0]), toDecimal(params[1]))
+		}
+	}
+
+	ops := []struct {
+		op    string
+		name  string
+		fn    func(a, b decimal.Decimal) (interface{}, error)
+		types []interface{}
+	}{
+		{"+", "decimalAdd", func(a, b decimal.Decimal) (interface{}, error) { return a.Add(b), nil }, arithmetic},
+		{"-", "decimalSub", func(a, b decimal.Decimal) (interface{}, error) { return a.Sub(b), nil }, arithmetic},
+		{"*", "decimalMul", func(a, b decimal.Decimal) (interface{}, error) { return a.Mul(b), nil }, arithmetic},
+		{"/", "decimalDiv", func(a, b decimal.Decimal) (interface{}, error) {
+			if b.IsZero() {
+				return decimal.Zero, fmt.Errorf("division by zero")
+			}
+			if o.divPrecision > 0 {
+				return a.DivRound(b, o.divPrecision), nil
+			}
+			return a.Div(b), nil
+		}, arithmetic},
+		{"<", "decimalLess", func(a, b decimal.Decimal) (interface{}, error) { return a.LessThan(b), nil }, comparison},
+		{"<=", "decimalLessOrEqual", func(a, b decimal.Decimal) (interface{}, error) { return a.LessThanOrEqual(b), nil }, comparison},
+		{">", "decimalGreater", func(a, b decimal.Decimal) (interface{}, error) { return a.GreaterThan(b), nil }, comparison},
+		{">=", "decimalGreaterOrEqual", func(a, b decimal.Decimal) (interface{}, error) { return a.GreaterThanOrEqual(b), nil }, comparison},
+		{"==", "decimalEqual", func(a, b decimal.Decimal) (interface{}, error) { return a.Equal(b), nil }, comparison},
+		{"!=", "decimalNotEqual", func(a, b decimal.Decimal) (interface{}, error) { return !a.Equal(b), nil }, comparison},
+	}
+	options := make([]expr.Option, 0, 2*len(ops)+2)
+	for _, op := range ops {
+		options = append(options,
+			expr.Function(op.name, binary(op.fn), op.types...),
+			expr.Operator(op.op, op.name),
+		)
+	}
+	return append(options,
+		expr.Function(decimalNegName, func(params ...interface{}) (interface{}, error) {
+			return toDecimal(params[0]).Neg(), nil
+		}, new(func(decimal.Decimal) decimal.Decimal)),
+		expr.Patch(&decimalNegPatcher{}),
+	)
+}
+
+// decimalNegName is the function unary minus on a decimal is rewritten to
+const decimalNegName = "decimalNeg"
+
+var decimalType = reflect.TypeOf(decimal.Decimal{})
+
+// decimalNegPatcher rewrites -x to decimalNeg(x) when x is a decimal; expr's
+// operator overloading only covers binary operators. It repeats alongside the
+// operator patchers, since x may only become a decimal once they have run.
+type decimalNegPatcher struct {
+	applied bool
+}
+
+func (p *decimalNegPatcher) Visit(node *ast.Node) {
+	unary, ok := (*node).(*ast.UnaryNode)
+	if !ok || unary.Operator != "-" || unary.Node.Type() != decimalType {
+		return
+	}
+	call := &ast.CallNode{
+		Callee:    &ast.IdentifierNode{Value: decimalNegName},
+		Arguments: []ast.Node{unary.Node},
+	}
+	call.SetType(decimalType)
+	ast.Patch(node, call)
+	p.applied = true
+}
+
+func (p *decimalNegPatcher) Reset() {
+	p.applied = false
+}
+
+func (p *decimalNegPatcher) ShouldRepeat() bool {
+	return p.applied
+}
+
+// exprDepth returns how deep expression arrays may nest
+func (o *exprOptions) exprDepth() int {
+	if o.maxExprDepth <= 0 {
+		return defaultMaxExprDepth
+	}
+	return o.maxExprDepth
+}
+
+// base returns the name of the base amount var
+func (o *exprOptions) base() string {
+	if o.baseVar == "" {
+		return "amount"
+	}
+	return o.baseVar
+}
+
+// EvalRule evaluates a single rule against vars without an engine, e.g. to
+// preview a rule in an editor. vars is not modified; assignments show up in
+// the result's context. A nil result means the rule produced nothing.
+func EvalRule(rule string, vars map[string]interface{}) (*RuleResult, error) {
+	ctx := &Context{
+		Vars:     make(map[string]interface{}, len(vars)),
+		FeeItems: make([]FeeItem, 0),
+	}
+	for k, v := range vars {
+		ctx.Vars[k] = v
+	}
+	result, err := executeExpression(rule, ctx, &exprOptions{}, 0, "")
+	if err != nil {
+		return nil, withRule(err, 0, rule)
+	}
+	return result, nil
 }
 
 // executeExpression executes an expression and returns rule result
@@ -196,13 +916,19 @@ func preprocessExpression(exprStr string) string {
 //   - FeeItem: saved as fee item
 //   - []string or []interface{} (strings): treated as array of expressions to execute
 //   - nil or other: treated as side effect (context changes tracked via SetVar)
-func executeExpression(exprStr string, ctx *Context) (*RuleResult, error) {
-	if exprStr == "" {
+//
+// Rules starting with "#" are notes: they are not evaluated, but still count
+// as processed and appear in the logs.
+func executeExpression(exprStr string, ctx *Context, opts *exprOptions, index int, name string) (*RuleResult, error) {
+	if exprStr == "" || isNote(exprStr) {
 		return nil, nil
 	}
+	if opts == nil {
+		opts = &exprOptions{}
+	}
 
 	// Preprocess expression to convert assignments to SetVar calls
-	preprocessed := preprocessExpression(exprStr)
+	statements := preprocessStatements(exprStr)
 
 	ctx.mu.RLock()
 	env := make(map[string]interface{})
@@ -210,20 +936,121 @@ func executeExpression(exprStr string, ctx *Context) (*RuleResult, error) {
 	// Keep variables as their original types for expression evaluation
 	// Numeric operations will be converted to decimal in newFeeItem
 	for k, v := range ctx.Vars {
+		if err := checkFinite(v); err != nil {
+			ctx.mu.RUnlock()
+			return nil, fmt.Errorf("var %q: %w", k, err)
+		}
+		env[k] = v
+	}
+
+	// Constants shadow variables of the same name
+	for k, v := range opts.constants {
 		env[k] = v
 	}
+	if opts.config != nil {
+		env[configKey] = opts.config
+	}
+
+	// Registered functions; built-in helpers below take precedence
+	for k, fn := range opts.funcs {
+		env[k] = fn
+	}
+
+	compileOptions := opts.compileOptions()
+
+	// Macros evaluate their body against the rule's env with params bound;
+	// built-in helpers below take precedence. Macros may call each other, so
+	// calls nest at most exprDepth deep.
+	macroDepth := 0
+	for name, m := range opts.macros {
+		name, m := name, m
+		env[name] = func(args ...interface{}) (interface{}, error) {
+			if len(args) != len(m.params) {
+				return nil, fmt.Errorf("macro %s takes %d arguments, got %d", name, len(m.params), len(args))
+			}
+			if macroDepth >= opts.exprDepth() {
+				return nil, fmt.Errorf("macro %s: macro calls nested too deep", name)
+			}
+			macroDepth++
+			defer func() { macroDepth-- }()
+			local := make(map[string]interface{}, len(env)+len(args))
+			for k, v := range env {
+				local[k] = v
+			}
+			for i, param := range m.params {
+				local[param] = args[i]
+			}
+			return executeSingleExpression(m.body, local, compileOptions...)
+		}
+	}
 
 	// Track context updates
 	contextUpdates := make(map[string]interface{})
 
 	// Add helper functions
-	env["$"] = newFeeItem
+	// $(amount, currency) creates a fee item; $(amount) uses the default currency
+	env["$"] = func(amount interface{}, currency ...interface{}) (FeeItem, error) {
+		switch len(currency) {
+		case 1:
+			code, err := currencyArg(currency[0])
+			if err != nil {
+				return FeeItem{}, err
+			}
+			return newFeeItem(amount, code)
+		case 0:
+			if opts.defaultCurrency == "" {
+				return FeeItem{}, fmt.Errorf("$ called without currency and no default currency is configured")
+			}
+			return newFeeItem(amount, opts.defaultCurrency)
+		default:
+			return FeeItem{}, fmt.Errorf("$ takes at most 2 arguments, got %d", len(currency)+1)
+		}
+	}
 
 	// Set function for variable assignment
-	env["Set"] = func(key string, value interface{}) interface{} {
+	set := func(key string, value interface{}) (interface{}, error) {
+		if _, ok := opts.constants[key]; ok {
+			return nil, fmt.Errorf("cannot assign to constant %q", key)
+		}
+		if key == configKey && opts.config != nil {
+			return nil, fmt.Errorf("cannot assign to %q", key)
+		}
 		contextUpdates[key] = value
 		env[key] = value
-		return nil
+		return nil, nil
+	}
+	env["Set"] = set
+
+	// Accumulate adds value to a running total var, starting from zero, and
+	// returns the new total. The total stays a float64 unless either side is
+	// a decimal.
+	env["Accumulate"] = func(key string, value interface{}) (interface{}, error) {
+		current, exists := env[key]
+		if exists && !isNumeric(current) {
+			return nil, fmt.Errorf("cannot accumulate into non-numeric var %q", key)
+		}
+		if err := checkFinite(value); err != nil {
+			return nil, fmt.Errorf("accumulate %q: %w", key, err)
+		}
+		sum := toDecimal(current).Add(toDecimal(value))
+		var total interface{} = sum
+		if !isDecimal(current) && !isDecimal(value) {
+			total = sum.InexactFloat64()
+		}
+		if _, err := set(key, total); err != nil {
+			return nil, err
+		}
+		return total, nil
+	}
+
+	// Warn records a non-fatal warning on the result
+	var warnings []string
+	env["Warn"] = func(message string) (interface{}, error) {
+		if opts.warnAsError {
+			return nil, fmt.Errorf("warning: %s", message)
+		}
+		warnings = append(warnings, message)
+		return nil, nil
 	}
 
 	// Add decimal arithmetic functions for expressions
@@ -238,40 +1065,389 @@ func executeExpression(exprStr string, ctx *Context) (*RuleResult, error) {
 	env["Mul"] = func(a, b interface{}) decimal.Decimal {
 		return toDecimal(a).Mul(toDecimal(b))
 	}
-	env["Div"] = func(a, b interface{}) decimal.Decimal {
-		return toDecimal(a).Div(toDecimal(b))
+	env["Div"] = func(a, b interface{}) (decimal.Decimal, error) {
+		d := toDecimal(b)
+		if d.IsZero() {
+			return decimal.Zero, fmt.Errorf("division by zero")
+		}
+		if opts.divPrecision > 0 {
+			return toDecimal(a).DivRound(d, opts.divPrecision), nil
+		}
+		return toDecimal(a).Div(d), nil
 	}
 	env["Neg"] = func(a interface{}) decimal.Decimal {
 		return toDecimal(a).Neg()
 	}
 
+	// Round and Quantize round with the engine's rounding mode, e.g.
+	// Round(fee, 2) or Quantize(fee, 0.05) for nickel rounding
+	env["Round"] = func(a interface{}, places int) decimal.Decimal {
+		return roundMode(toDecimal(a), int32(places), opts.roundingMode)
+	}
+	// BankRound applies banker's rounding to a currency's minor units
+	env["BankRound"] = func(a interface{}, currency string) (decimal.Decimal, error) {
+		info, ok := lookupCurrency(opts.currencies, currency)
+		if !ok {
+			return decimal.Zero, fmt.Errorf("unknown currency %q: add it with WithCurrencyTable", currency)
+		}
+		return toDecimal(a).RoundBank(info.MinorUnits), nil
+	}
+	env["Quantize"] = func(a, step interface{}) (decimal.Decimal, error) {
+		s := toDecimal(step)
+		if !s.IsPositive() {
+			return decimal.Zero, fmt.Errorf("quantize step must be positive, got %s", s.String())
+		}
+		q := toDecimal(a).DivRound(s, 16)
+		return roundMode(q, 0, opts.roundingMode).Mul(s), nil
+	}
+
+	// Comparisons that convert both sides to decimals, e.g. Gt(Fees("USD"), 500).
+	// The operators also compare decimals, but only against decimal, float64
+	// and int operands whose types are known when the rule compiles; these
+	// helpers take any mix of numeric types and numeric strings, and Eq
+	// compares by value across types, e.g. Eq(amount, "10.50").
+	env["Gt"] = func(a, b interface{}) bool {
+		return toDecimal(a).GreaterThan(toDecimal(b))
+	}
+	env["Gte"] = func(a, b interface{}) bool {
+		return toDecimal(a).GreaterThanOrEqual(toDecimal(b))
+	}
+	env["Lt"] = func(a, b interface{}) bool {
+		return toDecimal(a).LessThan(toDecimal(b))
+	}
+	env["Lte"] = func(a, b interface{}) bool {
+		return toDecimal(a).LessThanOrEqual(toDecimal(b))
+	}
+	env["Eq"] = func(a, b interface{}) bool {
+		return toDecimal(a).Equal(toDecimal(b))
+	}
+
+	// Array helpers for multi-leg amounts, e.g. Mul(Sum(legs), rate)
+	env["Sum"] = func(values interface{}) (decimal.Decimal, error) {
+		ds, err := toDecimals(values)
+		if err != nil {
+			return decimal.Zero, err
+		}
+		total := decimal.Zero
+		for _, d := range ds {
+			total = total.Add(d)
+		}
+		return total, nil
+	}
+	env["Product"] = func(values interface{}) (decimal.Decimal, error) {
+		ds, err := toDecimals(values)
+		if err != nil {
+			return decimal.Zero, err
+		}
+		product := decimal.NewFromInt(1)
+		for _, d := range ds {
+			product = product.Mul(d)
+		}
+		return product, nil
+	}
+	env["MapMul"] = func(values interface{}, scalar interface{}) ([]interface{}, error) {
+		ds, err := toDecimals(values)
+		if err != nil {
+			return nil, err
+		}
+		s := toDecimal(scalar)
+		out := make([]interface{}, len(ds))
+		for i, d := range ds {
+			out[i] = d.Mul(s)
+		}
+		return out, nil
+	}
+
+	// Integer division and modulo for per-unit fees, e.g. DivCeil(250, 100) == 3
+	env["DivCeil"] = func(a, b interface{}) (decimal.Decimal, error) {
+		return divInt(toDecimal(a), toDecimal(b), true)
+	}
+	env["DivFloor"] = func(a, b interface{}) (decimal.Decimal, error) {
+		return divInt(toDecimal(a), toDecimal(b), false)
+	}
+	env["Mod"] = func(a, b interface{}) (decimal.Decimal, error) {
+		d := toDecimal(b)
+		if d.IsZero() {
+			return decimal.Zero, fmt.Errorf("modulo by zero")
+		}
+		return toDecimal(a).Mod(d), nil
+	}
+
+	// BpsOf charges basis points of a reference value, e.g. BpsOf(notional, 25)
+	env["BpsOf"] = func(value, bps interface{}) decimal.Decimal {
+		return toDecimal(value).Mul(toDecimal(bps)).Div(decimal.NewFromInt(10000))
+	}
+
+	// PctOrFixed charges the greater of a percentage and a fixed fee, e.g.
+	// PctOrFixed(amount, 0.01, 5) for "1% or 5, whichever is greater"
+	env["PctOrFixed"] = func(amount, pct, fixed interface{}) decimal.Decimal {
+		return decimal.Max(toDecimal(amount).Mul(toDecimal(pct)), toDecimal(fixed))
+	}
+
+	// Prorate scales a fixed fee by the fraction of the period used,
+	// clamped to [0, 1] unless disabled with WithProrateClamp(false)
+	env["Prorate"] = func(fixed, fraction interface{}) decimal.Decimal {
+		f := toDecimal(fraction)
+		if !opts.prorateUnclamped {
+			if f.IsNegative() {
+				f = decimal.Zero
+			} else if f.GreaterThan(decimal.NewFromInt(1)) {
+				f = decimal.NewFromInt(1)
+			}
+		}
+		return toDecimal(fixed).Mul(f)
+	}
+
+	// Tax helpers: TaxInclusive extracts the tax embedded in a gross amount,
+	// TaxExclusive computes the tax added on top of a net amount
+	env["TaxInclusive"] = func(gross, rate interface{}) (decimal.Decimal, error) {
+		return taxInclusive(toDecimal(gross), toDecimal(rate))
+	}
+	env["TaxExclusive"] = func(net, rate interface{}) decimal.Decimal {
+		return toDecimal(net).Mul(toDecimal(rate))
+	}
+
+	// GrossUp is the closed-form inclusive amount for a purely proportional
+	// fee: the gross that leaves net after charging rate on it
+	env["GrossUp"] = func(net, rate interface{}) (decimal.Decimal, error) {
+		return grossUp(toDecimal(net), toDecimal(rate))
+	}
+
+	// Fees returns the total of the fee items of a currency recorded by
+	// earlier rules in this execution
+	env["Fees"] = func(currency string) decimal.Decimal {
+		total := decimal.Zero
+		ctx.mu.RLock()
+		defer ctx.mu.RUnlock()
+		for _, item := range ctx.FeeItems {
+			if item.Currency == normalizeCurrency(currency) {
+				total = total.Add(item.Amount)
+			}
+		}
+		return total
+	}
+
+	// Net returns the base amount minus the fees of the given currency recorded
+	// by earlier rules, for fees computed on the amount net of prior fees
+	env["Net"] = func(currency string) decimal.Decimal {
+		net := toDecimal(env[opts.base()])
+		ctx.mu.RLock()
+		defer ctx.mu.RUnlock()
+		for _, item := range ctx.FeeItems {
+			if item.Currency == normalizeCurrency(currency) {
+				net = net.Sub(item.Amount)
+			}
+		}
+		return net
+	}
+
+	env["Convert"] = func(amount interface{}, from, to string) (decimal.Decimal, error) {
+		return opts.rates.convert(toDecimal(amount), normalizeCurrency(from), normalizeCurrency(to))
+	}
+
+	// Prev returns the value a var held when the current Execute call started,
+	// e.g. to charge on the amount before an earlier rule changed it
+	env["Prev"] = func(name string) (interface{}, error) {
+		ctx.mu.RLock()
+		defer ctx.mu.RUnlock()
+		value, ok := ctx.callVars[name]
+		if !ok {
+			return nil, fmt.Errorf("var %q was not set when execution started", name)
+		}
+		return value, nil
+	}
+
+	// FeeItems returns a snapshot of the fee items recorded by earlier rules,
+	// e.g. any(FeeItems(), .amount > 100). Amounts are floats so they can be
+	// compared; pass them to the decimal helpers for exact arithmetic.
+	env["FeeItems"] = func() []interface{} {
+		ctx.mu.RLock()
+		defer ctx.mu.RUnlock()
+		items := make([]interface{}, len(ctx.FeeItems))
+		for i, item := range ctx.FeeItems {
+			tags := make(map[string]interface{}, len(item.Tags))
+			for k, v := range item.Tags {
+				tags[k] = v
+			}
+			items[i] = map[string]interface{}{
+				"amount":   item.Amount.InexactFloat64(),
+				"currency": string(item.Currency),
+				"label":    item.Label,
+				"tags":     tags,
+			}
+		}
+		return items
+	}
+
+	env["Split"] = splitFee
+	env["Case"] = caseOf
+	env["TierCapped"] = tierCapped
+	env["Return"] = func(v interface{}) returnValue {
+		return returnValue{value: v}
+	}
+
+	// Repeat runs a sub-expression n times, e.g. to compound a daily fee.
+	// Assignments carry over between iterations and fee items accumulate.
+	env["Repeat"] = func(n int, sub string) ([]interface{}, error) {
+		if n < 0 {
+			return nil, fmt.Errorf("repeat count must not be negative, got %d", n)
+		}
+		items := make([]interface{}, 0)
+		statements := preprocessStatements(sub)
+		for i := 0; i < n; i++ {
+			for _, stmt := range statements {
+				output, err := executeSingleExpression(strings.TrimSpace(stmt), env, compileOptions...)
+				if err != nil {
+					return nil, err
+				}
+				var feeItems []FeeItem
+				extractFeeItems(output, &feeItems)
+				for _, item := range feeItems {
+					items = append(items, item)
+				}
+			}
+		}
+		return items, nil
+	}
+
+	// Random helpers for weighted cohort assignment; deterministic only with WithSeed
+	env["Rand"] = func() float64 {
+		return opts.random().Float64()
+	}
+	env["RandPick"] = func(items []interface{}, weights []interface{}) (interface{}, error) {
+		return randPick(opts.random(), items, weights)
+	}
+	// SpreadFee charges the FX spread on an amount, amount * (sell - buy),
+	// e.g. SpreadFee(10000, 0.0099, 0.0101, "USD") for KES converted to USD
+	env["SpreadFee"] = func(amount, buyRate, sellRate interface{}, currency interface{}) (FeeItem, error) {
+		buy, sell := toDecimal(buyRate), toDecimal(sellRate)
+		if sell.LessThan(buy) {
+			return FeeItem{}, fmt.Errorf("sell rate %s is below buy rate %s", sell.String(), buy.String())
+		}
+		code, err := currencyArg(currency)
+		if err != nil {
+			return FeeItem{}, err
+		}
+		return newFeeItem(toDecimal(amount).Mul(sell.Sub(buy)), code)
+	}
+
+	// BucketFee creates a fee item in a bucket, e.g. a tax jurisdiction,
+	// for ExecuteResult.SummaryByBucket
+	env["BucketFee"] = func(amount interface{}, currency interface{}, bucket string) (FeeItem, error) {
+		code, err := currencyArg(currency)
+		if err != nil {
+			return FeeItem{}, err
+		}
+		item, err := newFeeItem(amount, code)
+		if err != nil {
+			return FeeItem{}, err
+		}
+		item.Bucket = bucket
+		return item, nil
+	}
+	env["TaggedFee"] = func(amount interface{}, currency string, tags map[string]interface{}) (FeeItem, error) {
+		item, err := newFeeItem(amount, currency)
+		if err != nil {
+			return FeeItem{}, err
+		}
+		item.Tags = make(map[string]string, len(tags))
+		for k, v := range tags {
+			item.Tags[k] = fmt.Sprint(v)
+		}
+		return item, nil
+	}
+
+	// Time helpers for surge and off-peak pricing, read from the engine clock
+	env["Hour"] = func() int {
+		return opts.now().Hour()
+	}
+	env["Weekday"] = func() int {
+		return int(opts.now().Weekday())
+	}
+	env["IsWeekend"] = func() bool {
+		day := opts.now().Weekday()
+		return day == time.Saturday || day == time.Sunday
+	}
+
+	// Stop halts execution once the current rule completes; the rule's own
+	// fee items and assignments still apply
+	stopped := false
+	env["Stop"] = func() interface{} {
+		stopped = true
+		return nil
+	}
+
+	env["Reversing"] = func() bool {
+		return opts.reversing
+	}
+
+	// Position and name of the rule being executed
+	env["RuleIndex"] = func() int {
+		return index
+	}
+	env["RuleName"] = func() string {
+		return name
+	}
+
 	ctx.mu.RUnlock()
 
+	if opts.sandbox != nil {
+		opts.sandbox.restrict(env)
+	}
+
 	// Check if preprocessing resulted in multiple statements (separated by semicolon)
 	// If so, we need to execute them sequentially
 	var finalExpr string
-	if strings.Contains(preprocessed, "; ") {
-		parts := strings.Split(preprocessed, "; ")
-		// Execute all parts except the last one (they are Set calls or other statements)
-		for i := 0; i < len(parts)-1; i++ {
-			part := strings.TrimSpace(parts[i])
+	var output interface{}
+	returned := false
+	if len(statements) > 1 {
+		// Execute all parts except the last one (they are Set calls or other statements),
+		// stopping early if one of them returns
+		for i := 0; i < len(statements)-1 && !returned; i++ {
+			part := rewriteReturn(strings.TrimSpace(statements[i]))
 			if part != "" {
+				opts.recordDeps(index, part, env, contextUpdates, compileOptions)
 				// Execute this part directly without recursion
-				_, err := executeSingleExpression(part, env)
+				partOutput, err := executeSingleExpression(part, env, compileOptions...)
 				if err != nil {
 					return nil, err
 				}
+				if rv, ok := partOutput.(returnValue); ok {
+					output, returned = rv.value, true
+				}
 			}
 		}
 		// Use the last part as the main expression
-		finalExpr = strings.TrimSpace(parts[len(parts)-1])
+		finalExpr = strings.TrimSpace(statements[len(statements)-1])
 	} else {
-		finalExpr = preprocessed
+		finalExpr = statements[0]
 	}
 
-	output, err := executeSingleExpression(finalExpr, env)
-	if err != nil {
-		return nil, err
+	if !returned {
+		finalExpr = rewriteReturn(finalExpr)
+		opts.recordDeps(index, finalExpr, env, contextUpdates, compileOptions)
+		if opts.checkTypes {
+			program, err := compileExpression(finalExpr, env, compileOptions...)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkResultType(program); err != nil {
+				return nil, &CompileError{Index: -1, Err: err}
+			}
+		}
+
+		var err error
+		output, err = executeSingleExpression(finalExpr, env, compileOptions...)
+		if err != nil {
+			return nil, err
+		}
+		if rv, ok := output.(returnValue); ok {
+			output = rv.value
+		}
+	}
+
+	if opts.strictNoOp && len(contextUpdates) == 0 && isDiscarded(output) {
+		return nil, &RuntimeError{Index: -1, Err: fmt.Errorf("rule result %v (%T) is discarded: emit a fee with $ or assign it to a var", output, output)}
 	}
 
 	result := &RuleResult{
@@ -284,12 +1460,8 @@ func executeExpression(exprStr string, ctx *Context) (*RuleResult, error) {
 	// Extract FeeItems from output
 	if len(expressionsToProcess) > 0 {
 		// Execute array of expressions
-		for _, subExpr := range expressionsToProcess {
-			subOutput, err := executeSingleExpression(subExpr, env)
-			if err != nil {
-				return nil, err
-			}
-			extractFeeItems(subOutput, &result.FeeItems)
+		if err := executeExpressionArray(expressionsToProcess, env, opts.exprDepth(), &result.FeeItems, compileOptions...); err != nil {
+			return nil, err
 		}
 	} else if output != nil {
 		// Single expression result
@@ -304,7 +1476,10 @@ func executeExpression(exprStr string, ctx *Context) (*RuleResult, error) {
 		}
 	}
 
-	if len(result.FeeItems) == 0 && result.Context == nil {
+	result.Warnings = warnings
+	result.Halt = stopped
+
+	if len(result.FeeItems) == 0 && result.Context == nil && len(result.Warnings) == 0 && !result.Halt {
 		return nil, nil
 	}
 
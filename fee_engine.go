@@ -1,9 +1,16 @@
 package feecalc
 
 import (
+	"bufio"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
@@ -24,12 +31,142 @@ func (c *Context) Copy() *Context {
 	newLogs := make([]Log, len(c.Logs))
 	copy(newLogs, c.Logs)
 
+	newWarnings := make([]string, len(c.Warnings))
+	copy(newWarnings, c.Warnings)
+
 	return &Context{
 		Vars:             newVars,
 		FeeItems:         newFeeItems,
 		Logs:             newLogs,
+		Warnings:         newWarnings,
 		lastExecutedRule: c.lastExecutedRule,
+		initialVars:      c.initialVars,
+		callVars:         c.callVars,
+		TxID:             c.TxID,
+	}
+}
+
+// EqualOption configures what Context.Equal compares
+type EqualOption func(*equalConfig)
+
+type equalConfig struct {
+	cursor bool
+	logs   bool
+}
+
+// CompareCursor makes Context.Equal also compare the execution position
+func CompareCursor() EqualOption {
+	return func(c *equalConfig) { c.cursor = true }
+}
+
+// CompareLogs makes Context.Equal also compare logs
+func CompareLogs() EqualOption {
+	return func(c *equalConfig) { c.logs = true }
+}
+
+// Equal reports whether two contexts hold the same vars and fee items. Numeric
+// vars are compared by value, so 1.5 equals decimal "1.5". Fee items compare
+// amount, currency and label. Logs and the execution position are ignored
+// unless requested with CompareLogs and CompareCursor.
+func (c *Context) Equal(other *Context, opts ...EqualOption) bool {
+	if c == nil || other == nil {
+		return c == other
+	}
+	var cfg equalConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c != other {
+		other.mu.RLock()
+		defer other.mu.RUnlock()
+	}
+
+	if cfg.cursor && c.lastExecutedRule != other.lastExecutedRule {
+		return false
+	}
+	if !varsEqual(c.Vars, other.Vars) || !feeItemsEqual(c.FeeItems, other.FeeItems) {
+		return false
+	}
+	if cfg.logs {
+		if len(c.Logs) != len(other.Logs) {
+			return false
+		}
+		for i, l := range c.Logs {
+			o := other.Logs[i]
+			if l.Rule != o.Rule || l.Preprocessed != o.Preprocessed ||
+				!varsEqual(l.Vars, o.Vars) || !feeItemsEqual(l.FeeItems, o.FeeItems) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// varsEqual compares var maps, treating numeric values as decimals
+func varsEqual(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, av := range a {
+		bv, ok := b[k]
+		if !ok {
+			return false
+		}
+		if checkFinite(av) != nil || checkFinite(bv) != nil {
+			// NaN never equals itself; matching infinities do
+			if av != bv {
+				return false
+			}
+		} else if isNumeric(av) && isNumeric(bv) {
+			if !toDecimal(av).Equal(toDecimal(bv)) {
+				return false
+			}
+		} else if !reflect.DeepEqual(av, bv) {
+			return false
+		}
+	}
+	return true
+}
+
+// feeItemsEqual compares fee items by amount, currency and label
+func feeItemsEqual(a, b []FeeItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Amount.Equal(b[i].Amount) || a[i].Currency != b[i].Currency || a[i].Label != b[i].Label {
+			return false
+		}
+	}
+	return true
+}
+
+// captureInitialVars snapshots the current vars as the execution's starting point
+func (c *Context) captureInitialVars() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.initialVars = c.snapshotVars()
+}
+
+// captureCallVars records the vars at the start of an execute call for Prev
+func (c *Context) captureCallVars() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.callVars = c.snapshotVars()
+}
+
+// snapshotVars returns a shallow copy of the vars; callers hold the lock
+func (c *Context) snapshotVars() map[string]interface{} {
+	vars := make(map[string]interface{}, len(c.Vars))
+	for k, v := range c.Vars {
+		vars[k] = v
 	}
+	return vars
 }
 
 // SetVar sets a variable in the context
@@ -47,6 +184,31 @@ func (c *Context) getVar(key string) (interface{}, bool) {
 	return val, ok
 }
 
+// getVarDecimal gets a variable from the context converted to decimal. Values
+// that are not numbers, decimals or numeric strings report false.
+func (c *Context) getVarDecimal(key string) (decimal.Decimal, bool) {
+	val, ok := c.getVar(key)
+	if !ok || checkFinite(val) != nil {
+		return decimal.Zero, false
+	}
+	switch v := val.(type) {
+	case string:
+		d, err := decimal.NewFromString(v)
+		if err != nil {
+			return decimal.Zero, false
+		}
+		return d, true
+	case *decimal.Decimal:
+		if v == nil {
+			return decimal.Zero, false
+		}
+	}
+	if !isNumeric(val) {
+		return decimal.Zero, false
+	}
+	return toDecimal(val), true
+}
+
 // addFeeItem adds a fee item to the context
 func (c *Context) addFeeItem(item FeeItem) {
 	c.mu.Lock()
@@ -61,11 +223,16 @@ func (c *Context) addLog(log Log) {
 	c.Logs = append(c.Logs, log)
 }
 
+func (c *Context) addWarnings(warnings []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Warnings = append(c.Warnings, warnings...)
+}
+
 // New creates a new instance of FeeEngine with the given context
 func New(ctx *Context) *FeeEngine {
 	if ctx == nil {
 		ctx = &Context{
-			ctxJson:          make([]byte, 0),
 			Vars:             make(map[string]interface{}),
 			FeeItems:         make([]FeeItem, 0),
 			Logs:             make([]Log, 0),
@@ -73,16 +240,12 @@ func New(ctx *Context) *FeeEngine {
 			enableLog:        false,
 		}
 	} else {
-
-		jsonData, err := json.Marshal(ctx.Vars)
-		if err != nil {
-			log.Fatalf("Failed to marshal context: %v", err)
-		}
-		ctx.ctxJson = jsonData
+		// Kept typed so decimal vars are still decimals after Reset
+		ctx.resetVars = ctx.snapshotVars()
 	}
 	return &FeeEngine{
 		ctx:   ctx,
-		rules: make([]string, 0),
+		rules: make([]rule, 0),
 	}
 }
 
@@ -91,104 +254,840 @@ func (e *FeeEngine) EnableLog() *FeeEngine {
 	return e
 }
 
-// AddRule adds one or more fee rules to the engine
+// WithLogWriter streams each log entry to w as a JSON line (NDJSON).
+// Entries are written whether or not EnableLog is set; EnableLog only
+// controls whether they are also kept in memory on the context.
+// If w implements Flush() error, it is flushed after every rule.
+func (e *FeeEngine) WithLogWriter(w io.Writer) *FeeEngine {
+	e.logWriter = w
+	return e
+}
+
+// WithLogLevel sets how much detail log entries record. LogLevelMinimal skips
+// the per-rule var snapshot, which is the bulk of logging cost.
+func (e *FeeEngine) WithLogLevel(level LogLevel) *FeeEngine {
+	e.logLevel = level
+	return e
+}
+
+// WithExpectedCurrencies restricts the summary to the given currencies.
+// Execution fails if any other currency shows up in the summary.
+func (e *FeeEngine) WithExpectedCurrencies(currencies []string) *FeeEngine {
+	e.expectedCurrencies = make(map[Currency]bool, len(currencies))
+	for _, c := range currencies {
+		e.expectedCurrencies[normalizeCurrency(c)] = true
+	}
+	return e
+}
+
+// WithAllowEmptyRules makes Execute return an empty result instead of
+// ErrNoRules when the engine has no rules
+func (e *FeeEngine) WithAllowEmptyRules(allow bool) *FeeEngine {
+	e.allowEmptyRules = allow
+	return e
+}
+
+// WithConstants registers values available to every rule that are not part of
+// the context vars: Reset and Copy leave them alone and rules cannot assign to
+// them. If a constant and a var share a name, the constant wins.
+func (e *FeeEngine) WithConstants(constants map[string]interface{}) *FeeEngine {
+	e.opts.constants = make(map[string]interface{}, len(constants))
+	for k, v := range constants {
+		e.opts.constants[k] = v
+	}
+	return e
+}
+
+// WithConfig exposes a struct or map to rules as cfg, so rules can read
+// cfg.fiat_fee_rate instead of many flat vars. Struct fields are matched by
+// name or by an `expr:"name"` tag. Like constants, cfg survives Reset and
+// cannot be assigned by rules, and it shadows a var named cfg.
+func (e *FeeEngine) WithConfig(cfg interface{}) *FeeEngine {
+	e.opts.config = cfg
+	return e
+}
+
+// WithRounding rounds result fee items and summary lines to the given number
+// of decimal places. The context keeps the unrounded amounts.
+func (e *FeeEngine) WithRounding(places int32) *FeeEngine {
+	e.rounding = true
+	e.roundPlaces = places
+	return e
+}
+
+// WithResidualAllocation makes rounded results reconcile exactly: any
+// difference between a rounded summary line and the sum of its rounded items
+// is added to the largest item of that currency. Only applies with WithRounding.
+func (e *FeeEngine) WithResidualAllocation(enabled bool) *FeeEngine {
+	e.allocateResidual = enabled
+	return e
+}
+
+// WithFeeItemInterceptor registers a hook called for every fee item before it
+// is recorded. It may return a transformed item, or an error to abort execution.
+func (e *FeeEngine) WithFeeItemInterceptor(fn func(FeeItem) (FeeItem, error)) *FeeEngine {
+	e.interceptor = fn
+	return e
+}
+
+// WithBaseVar sets the var holding the transacting amount used by Net.
+// Defaults to "amount".
+func (e *FeeEngine) WithBaseVar(name string) *FeeEngine {
+	e.opts.baseVar = name
+	return e
+}
+
+// WithReverseNegation controls whether ExecuteReverse negates the fee items it
+// produces. Enabled by default.
+func (e *FeeEngine) WithReverseNegation(negate bool) *FeeEngine {
+	e.keepReverseSign = !negate
+	return e
+}
+
+// WithDefaultCurrency lets rules omit the currency: $(amount) is then
+// equivalent to $(amount, currency)
+func (e *FeeEngine) WithDefaultCurrency(currency string) *FeeEngine {
+	e.opts.defaultCurrency = currency
+	return e
+}
+
+// WithSummaryTags makes summary lines carry the tags that all fee items of
+// their currency agree on
+func (e *FeeEngine) WithSummaryTags(enabled bool) *FeeEngine {
+	e.summaryTags = enabled
+	return e
+}
+
+// WithSeed seeds the random source behind Rand and RandPick so executions are
+// reproducible. Reset re-seeds it. Without a seed, rules using them are
+// nondeterministic.
+func (e *FeeEngine) WithSeed(seed int64) *FeeEngine {
+	e.seed = seed
+	e.seeded = true
+	e.opts.rng = rand.New(rand.NewSource(seed))
+	return e
+}
+
+// WithWarnAsError makes Warn fail the calling rule instead of recording a
+// warning on the result
+func (e *FeeEngine) WithWarnAsError(enabled bool) *FeeEngine {
+	e.opts.warnAsError = enabled
+	return e
+}
+
+// WithClock sets the time source for the Hour, Weekday and IsWeekend helpers.
+// Times are read in the location of the returned time.
+func (e *FeeEngine) WithClock(clock func() time.Time) *FeeEngine {
+	e.opts.clock = clock
+	return e
+}
+
+// WithMaxFeeItems caps the number of fee items an execution may accumulate,
+// guarding against rules that emit runaway expression arrays. Execution fails
+// at the rule that would exceed n. Zero means unlimited.
+func (e *FeeEngine) WithMaxFeeItems(n int) *FeeEngine {
+	e.maxFeeItems = n
+	return e
+}
+
+// WithStrictNoOp makes Execute fail on rules whose result is discarded
+// without effect, such as a bare `amount * rate` that forgot to emit a fee
+func (e *FeeEngine) WithStrictNoOp(strict bool) *FeeEngine {
+	e.opts.strictNoOp = strict
+	return e
+}
+
+// WithDecimalContext sets the decimal behavior of the arithmetic helpers for
+// this engine: Div rounds its quotient to divPrecision places (half away from
+// zero), and Round and Quantize use mode. A divPrecision of zero keeps the
+// decimal package default. Result rounding set with WithRounding is not
+// affected.
+func (e *FeeEngine) WithDecimalContext(divPrecision int32, mode RoundingMode) *FeeEngine {
+	e.opts.divPrecision = divPrecision
+	e.opts.roundingMode = mode
+	return e
+}
+
+// WithMaxExprDepth limits how deep expression arrays may evaluate to further
+// expression arrays, and how deep macro calls may nest, before the rule fails,
+// guarding against configs and macros that recurse. n <= 0 restores the
+// default of 16.
+func (e *FeeEngine) WithMaxExprDepth(n int) *FeeEngine {
+	e.opts.maxExprDepth = n
+	return e
+}
+
+// WithProrateClamp controls whether Prorate clamps its fraction to [0, 1].
+// Clamping is on by default; disable it to charge e.g. overage periods.
+func (e *FeeEngine) WithProrateClamp(clamp bool) *FeeEngine {
+	e.opts.prorateUnclamped = !clamp
+	return e
+}
+
+// WithSummaryMultiplier scales every summary line by m, e.g. 0.9 for 10% off
+// all fees. Fee items keep their unscaled amounts, so the summary no longer
+// equals their sum. Lines are scaled after residual allocation and rounded
+// again when rounding is enabled. There is no flooring: a negative line
+// (net discount) is scaled like any other and stays negative.
+func (e *FeeEngine) WithSummaryMultiplier(m decimal.Decimal) *FeeEngine {
+	e.summaryMultiplier = &m
+	return e
+}
+
+// WithDropZeroFees discards fee items whose amount is zero instead of adding
+// them to the context, so they are neither in the result nor streamed. Log
+// entries still list them as produced by the rule.
+func (e *FeeEngine) WithDropZeroFees(drop bool) *FeeEngine {
+	e.dropZeroFees = drop
+	return e
+}
+
+// WithTxID sets a transaction ID that is carried into results and log
+// entries, e.g. to trace fees back to a payment. It is kept across Reset.
+func (e *FeeEngine) WithTxID(id string) *FeeEngine {
+	e.ctx.TxID = id
+	return e
+}
+
+// WithGuardDoubleExecute makes Execute and ExecuteContext fail with
+// ErrAlreadyExecuted when every rule has already run (or execution halted)
+// since the last Reset, catching callers that execute twice by mistake
+func (e *FeeEngine) WithGuardDoubleExecute(guard bool) *FeeEngine {
+	e.guardDoubleExecute = guard
+	return e
+}
+
+// WithZeroSummaryLines keeps summary lines whose total is zero, which are
+// dropped by default
+func (e *FeeEngine) WithZeroSummaryLines(keep bool) *FeeEngine {
+	e.keepZeroSummary = keep
+	return e
+}
+
+// DefineMacro registers a function callable from rules as name(args...),
+// whose body is itself a rule expression with params bound to the arguments,
+// e.g. DefineMacro("pctFee", []string{"amt", "r"}, "amt * r + 50"). Macros
+// can read vars and call helpers and other macros; recursive calls fail once
+// they nest deeper than WithMaxExprDepth allows. Built-in helpers cannot be
+// overridden.
+func (e *FeeEngine) DefineMacro(name string, params []string, body string) *FeeEngine {
+	if e.opts.macros == nil {
+		e.opts.macros = make(map[string]macro)
+	}
+	e.opts.macros[name] = macro{params: append([]string(nil), params...), body: body}
+	return e
+}
+
+// AddRule adds one or more fee rules to the engine. If a final rule is set,
+// the rules are inserted before it.
 func (e *FeeEngine) AddRule(rules ...string) *FeeEngine {
-	e.rules = append(e.rules, rules...)
+	for _, r := range rules {
+		e.appendRule(rule{expr: r})
+	}
 	return e
 }
 
+// AddNamedRule adds a rule with a name, available to the rule as RuleName()
+func (e *FeeEngine) AddNamedRule(name string, expr string) *FeeEngine {
+	e.appendRule(rule{expr: expr, name: name})
+	return e
+}
+
+// AddTaggedRule adds a rule carrying tags, which ExecuteTagged selects on
+func (e *FeeEngine) AddTaggedRule(tags []string, expr string) *FeeEngine {
+	e.appendRule(rule{expr: expr, tags: append([]string(nil), tags...)})
+	return e
+}
+
+// AddRuleIf adds a rule that only runs when flagExpr, evaluated against the
+// constants (see WithConstants), is true, e.g. for feature flags. The
+// condition is resolved once at the start of each execute call; vars are not
+// visible to it.
+func (e *FeeEngine) AddRuleIf(flagExpr string, expr string) *FeeEngine {
+	e.appendRule(rule{expr: expr, enableIf: flagExpr})
+	return e
+}
+
+// disabledRules evaluates the AddRuleIf conditions and returns the indexes
+// of the rules they turn off
+func (e *FeeEngine) disabledRules() (map[int]bool, error) {
+	disabled := make(map[int]bool)
+	for i, r := range e.rules {
+		if r.enableIf == "" {
+			continue
+		}
+		env := make(map[string]interface{}, len(e.opts.constants))
+		for k, v := range e.opts.constants {
+			env[k] = v
+		}
+		output, err := executeSingleExpression(r.enableIf, env)
+		if err != nil {
+			return nil, fmt.Errorf("error evaluating enable condition of rule at index %d: %w", i, err)
+		}
+		enabled, ok := output.(bool)
+		if !ok {
+			return nil, fmt.Errorf("enable condition of rule at index %d must be a boolean, got %T", i, output)
+		}
+		if !enabled {
+			disabled[i] = true
+		}
+	}
+	return disabled, nil
+}
+
+// AddFinalRule adds a closing rule that always runs last and halts execution
+// once it has run. Rules added afterwards are inserted before it. An engine
+// has at most one final rule.
+func (e *FeeEngine) AddFinalRule(expr string) error {
+	if n := len(e.rules); n > 0 && e.rules[n-1].final {
+		return fmt.Errorf("final rule already set: %s", e.rules[n-1].expr)
+	}
+	e.rules = append(e.rules, rule{expr: expr, final: true})
+	return nil
+}
+
+// appendRule adds r at the end, keeping a final rule last
+func (e *FeeEngine) appendRule(r rule) {
+	n := len(e.rules)
+	if n == 0 || !e.rules[n-1].final {
+		e.rules = append(e.rules, r)
+		return
+	}
+	e.rules = append(e.rules[:n-1], r, e.rules[n-1])
+}
+
+// AddTemplate substitutes {{param}} placeholders in rule with values from
+// params and adds the resulting rule. Unlike vars, params are pasted into the
+// rule text, so they can supply currency codes or literals. It fails if a
+// placeholder has no param.
+func (e *FeeEngine) AddTemplate(rule string, params map[string]string) error {
+	expanded, err := expandTemplate(rule, params)
+	if err != nil {
+		return err
+	}
+	e.AddRule(expanded)
+	return nil
+}
+
+// AddRulesFromReader adds one rule per line read from r, skipping blank
+// lines and lines starting with #, and returns the number of rules added.
+// Rules read before a read error are kept.
+func (e *FeeEngine) AddRulesFromReader(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	added := 0
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e.AddRule(line)
+		added++
+	}
+	if err := scanner.Err(); err != nil {
+		return added, fmt.Errorf("failed to read rules after %d added: %w", added, err)
+	}
+	return added, nil
+}
+
 func (e *FeeEngine) Reset() *FeeEngine {
-	// clear internal state, keep rules
-	e.ctx.Vars = make(map[string]interface{})
-	json.Unmarshal(e.ctx.ctxJson, &e.ctx.Vars)
-	e.ctx.FeeItems = make([]FeeItem, 0)
+	e.reset()
 	e.ctx.Logs = make([]Log, 0)
-	e.ctx.lastExecutedRule = 0
+	e.ctx.iteration = 0
+	return e
+}
+
+// ResetKeepLogs resets like Reset but keeps the logs of earlier runs, e.g. to
+// audit every iteration of a Reset().Execute() loop. If logging is enabled, a
+// "# iteration N" entry marks where each new run's logs start.
+func (e *FeeEngine) ResetKeepLogs() *FeeEngine {
+	e.reset()
+	e.ctx.iteration++
+	if e.ctx.enableLog {
+		e.ctx.addLog(Log{Rule: fmt.Sprintf("# iteration %d", e.ctx.iteration+1)})
+	}
 	return e
 }
 
+// reset clears internal state other than logs, keeping rules
+func (e *FeeEngine) reset() {
+	e.ctx.Vars = make(map[string]interface{}, len(e.ctx.resetVars))
+	for k, v := range e.ctx.resetVars {
+		e.ctx.Vars[k] = v
+	}
+	e.ctx.FeeItems = make([]FeeItem, 0)
+	e.ctx.Warnings = nil
+	e.ctx.lastExecutedRule = 0
+	e.ctx.halted = false
+	if e.seeded {
+		e.opts.rng = rand.New(rand.NewSource(e.seed))
+	}
+}
+
 func (e *FeeEngine) SetVar(key string, value interface{}) *FeeEngine {
 	e.ctx.setVar(key, value)
 	return e
 }
 
+// SetVarDecimal sets a variable to a decimal value
+func (e *FeeEngine) SetVarDecimal(key string, value decimal.Decimal) *FeeEngine {
+	e.ctx.setVar(key, value)
+	return e
+}
+
+// SetVarString parses a numeric string and stores it as a decimal, avoiding a
+// float64 intermediary
+func (e *FeeEngine) SetVarString(key string, value string) error {
+	d, err := decimal.NewFromString(value)
+	if err != nil {
+		return fmt.Errorf("invalid decimal value for %q: %w", key, err)
+	}
+	e.ctx.setVar(key, d)
+	return nil
+}
+
 func (e *FeeEngine) GetVar(key string) (interface{}, bool) {
 	return e.ctx.getVar(key)
 }
 
+// GetVarDecimal gets a variable converted to decimal, regardless of whether it
+// is stored as a decimal, float, int or numeric string. Other values, such as
+// "USD" or true, and NaN and infinite floats report false.
+func (e *FeeEngine) GetVarDecimal(key string) (decimal.Decimal, bool) {
+	return e.ctx.getVarDecimal(key)
+}
+
+// DistributeDiscount subtracts a discount from the accumulated fee items of the
+// given currency, pro-rata to each item's amount. Only positive items take a
+// share, and no item is reduced below zero. A NaN or infinite amount is
+// ignored, like a non-positive one.
+func (e *FeeEngine) DistributeDiscount(amount interface{}, currency string) *FeeEngine {
+	if checkFinite(amount) != nil {
+		return e
+	}
+	discount := toDecimal(amount)
+
+	e.ctx.mu.Lock()
+	defer e.ctx.mu.Unlock()
+
+	total := decimal.Zero
+	eligible := make([]int, 0)
+	for i, item := range e.ctx.FeeItems {
+		if item.Currency == normalizeCurrency(currency) && item.Amount.IsPositive() {
+			total = total.Add(item.Amount)
+			eligible = append(eligible, i)
+		}
+	}
+	if len(eligible) == 0 || !discount.IsPositive() {
+		return e
+	}
+
+	if discount.GreaterThanOrEqual(total) {
+		for _, i := range eligible {
+			e.ctx.FeeItems[i].Amount = decimal.Zero
+		}
+		return e
+	}
+
+	// The last item takes the remainder so the shares add up exactly
+	remaining := discount
+	for n, i := range eligible {
+		share := remaining
+		if n < len(eligible)-1 {
+			share = discount.Mul(e.ctx.FeeItems[i].Amount).Div(total)
+		}
+		if share.GreaterThan(e.ctx.FeeItems[i].Amount) {
+			share = e.ctx.FeeItems[i].Amount
+		}
+		e.ctx.FeeItems[i].Amount = e.ctx.FeeItems[i].Amount.Sub(share)
+		remaining = remaining.Sub(share)
+	}
+	return e
+}
+
 // Execute executes all remaining rules from the current position
 func (e *FeeEngine) Execute() (*ExecuteResult, error) {
+	if len(e.rules) == 0 {
+		if e.allowEmptyRules {
+			return e.buildExecuteResult(0)
+		}
+		return nil, ErrNoRules
+	}
+	if e.guardDoubleExecute && e.IsComplete() {
+		return nil, ErrAlreadyExecuted
+	}
 	remaining := len(e.rules) - e.ctx.lastExecutedRule
 	return e.ExecuteN(remaining)
 }
 
+// ExecuteContext executes all remaining rules like Execute, stopping before
+// the next rule once ctx is done and returning the context's error
+func (e *FeeEngine) ExecuteContext(ctx context.Context) (*ExecuteResult, error) {
+	if len(e.rules) == 0 {
+		if e.allowEmptyRules {
+			return e.buildExecuteResult(0)
+		}
+		return nil, ErrNoRules
+	}
+	if e.guardDoubleExecute && e.IsComplete() {
+		return nil, ErrAlreadyExecuted
+	}
+	remaining := len(e.rules) - e.ctx.lastExecutedRule
+	return e.executeN(ctx, remaining)
+}
+
 // ExecuteN executes N rules starting from the last executed position
 func (e *FeeEngine) ExecuteN(count int) (*ExecuteResult, error) {
+	return e.executeN(context.Background(), count)
+}
+
+func (e *FeeEngine) executeN(ctx context.Context, count int) (*ExecuteResult, error) {
 	if e.ctx == nil {
 		return nil, fmt.Errorf("context cannot be nil")
 	}
 
 	if count <= 0 {
-		return nil, fmt.Errorf("count must be positive")
+		return nil, ErrInvalidCount
 	}
 
+	start := time.Now()
+	processed := 0
+	defer func() {
+		e.profiler.record(processed, time.Since(start))
+	}()
+
 	startIndex := e.ctx.lastExecutedRule
 	if startIndex >= len(e.rules) {
 		return e.buildExecuteResult(0)
 	}
 
+	if startIndex == 0 {
+		e.ctx.captureInitialVars()
+	}
+	e.ctx.captureCallVars()
+
 	endIndex := startIndex + count
 	if endIndex > len(e.rules) {
 		endIndex = len(e.rules)
 	}
 
+	disabled, err := e.disabledRules()
+	if err != nil {
+		return nil, err
+	}
+
+	i := startIndex
+	for ; i < endIndex && !e.ctx.halted; i++ {
+		if err := ctx.Err(); err != nil {
+			e.ctx.lastExecutedRule = i
+			return nil, fmt.Errorf("execution stopped before rule at index %d: %w", i, err)
+		}
+		if disabled[i] {
+			continue
+		}
+		if err := e.processRule(i); err != nil {
+			return nil, err
+		}
+		processed++
+	}
+
+	// A halt leaves the cursor after the rule that stopped execution
+	e.ctx.lastExecutedRule = i
+	return e.buildExecuteResult(processed)
+}
+
+// ExecuteStream executes all remaining rules like Execute, passing each fee
+// item to fn as soon as it is produced instead of keeping it on the context,
+// so large rule sets need not be buffered. An error from fn aborts execution
+// and is returned wrapped. Log entries still record each rule's fee items
+// when logging is enabled.
+func (e *FeeEngine) ExecuteStream(fn func(FeeItem) error) error {
+	e.stream = fn
+	defer func() {
+		e.stream = nil
+	}()
+	_, err := e.Execute()
+	return err
+}
+
+// ExecuteReverse resets the engine and runs all rules from last to first, e.g.
+// to compute a refund. Rules can branch on Reversing(). Fee items produced in
+// reverse are negated unless disabled with WithReverseNegation(false).
+// Var assignments are not inverted: rules that rely on vars computed by
+// earlier rules may need a Reversing() branch to give meaningful results.
+func (e *FeeEngine) ExecuteReverse() (*ExecuteResult, error) {
+	if len(e.rules) == 0 {
+		if e.allowEmptyRules {
+			return e.buildExecuteResult(0)
+		}
+		return nil, ErrNoRules
+	}
+
+	start := time.Now()
 	processed := 0
-	for i := startIndex; i < endIndex; i++ {
-		rule := e.rules[i]
+	defer func() {
+		e.profiler.record(processed, time.Since(start))
+	}()
+
+	disabled, err := e.disabledRules()
+	if err != nil {
+		return nil, err
+	}
+
+	e.Reset()
+	e.ctx.captureInitialVars()
+	e.ctx.captureCallVars()
+	e.opts.reversing = true
+	defer func() {
+		e.opts.reversing = false
+	}()
+
+	for i := len(e.rules) - 1; i >= 0; i-- {
+		if disabled[i] {
+			continue
+		}
+		if err := e.processRule(i); err != nil {
+			return nil, err
+		}
+		processed++
+	}
+
+	e.ctx.lastExecutedRule = len(e.rules)
+	return e.buildExecuteResult(processed)
+}
+
+// ExecuteWith executes the remaining rules like Execute with overrides
+// applied, e.g. to price a what-if rate. It runs on a copy of the context and
+// options, so the engine's vars, position and configured values are left
+// unchanged. Seeded random helpers start over from the seed.
+func (e *FeeEngine) ExecuteWith(overrides Overrides) (*ExecuteResult, error) {
+	return e.runCopy(overrides).Execute()
+}
+
+// runCopy returns a copy of the engine for ExecuteWith and Preview, with its
+// own context and the overrides applied
+func (e *FeeEngine) runCopy(overrides Overrides) *FeeEngine {
+	run := *e
+	run.ctx = e.ctx.Copy()
+	run.ctx.resetVars = e.ctx.resetVars
+	run.ctx.enableLog = e.ctx.enableLog
+	run.ctx.halted = e.ctx.halted
+	run.ctx.iteration = e.ctx.iteration
+	for k, v := range overrides.Vars {
+		run.ctx.setVar(k, v)
+	}
+
+	if len(overrides.Constants) > 0 {
+		run.opts.constants = make(map[string]interface{}, len(e.opts.constants)+len(overrides.Constants))
+		for k, v := range e.opts.constants {
+			run.opts.constants[k] = v
+		}
+		for k, v := range overrides.Constants {
+			run.opts.constants[k] = v
+		}
+	}
+	if len(overrides.Rates) > 0 {
+		run.opts.rates = make(rateTable, len(e.opts.rates)+len(overrides.Rates))
+		for pair, r := range e.opts.rates {
+			run.opts.rates[pair] = r
+		}
+		run.WithRates(overrides.Rates...)
+	}
+
+	run.opts.rng = nil
+	if e.seeded {
+		run.opts.rng = rand.New(rand.NewSource(e.seed))
+	}
+	return &run
+}
+
+// Preview executes the remaining rules like Execute on a copy of the context
+// and returns the result, leaving the engine's vars, fee items and position
+// untouched. Nothing is written to the log writer or an ExecuteStream callback.
+func (e *FeeEngine) Preview() (*ExecuteResult, error) {
+	run := e.runCopy(Overrides{})
+	run.logWriter = nil
+	run.stream = nil
+	return run.Execute()
+}
+
+// ExecuteTagged resets the engine and runs only the rules carrying tag, in
+// order, so the result covers just their fee items. A final rule only runs if
+// it carries the tag.
+func (e *FeeEngine) ExecuteTagged(tag string) (*ExecuteResult, error) {
+	if len(e.rules) == 0 {
+		if e.allowEmptyRules {
+			return e.buildExecuteResult(0)
+		}
+		return nil, ErrNoRules
+	}
+
+	start := time.Now()
+	processed := 0
+	defer func() {
+		e.profiler.record(processed, time.Since(start))
+	}()
+
+	disabled, err := e.disabledRules()
+	if err != nil {
+		return nil, err
+	}
+
+	e.Reset()
+	e.ctx.captureInitialVars()
+	e.ctx.captureCallVars()
+	for i := 0; i < len(e.rules) && !e.ctx.halted; i++ {
+		if !e.rules[i].hasTag(tag) || disabled[i] {
+			continue
+		}
+		if err := e.processRule(i); err != nil {
+			return nil, err
+		}
+		processed++
+	}
+
+	e.ctx.lastExecutedRule = len(e.rules)
+	return e.buildExecuteResult(processed)
+}
+
+// hasTag reports whether the rule carries tag
+func (r rule) hasTag(tag string) bool {
+	for _, t := range r.tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
 
-		result, err := e.executeRule(rule)
+// ExecuteBatch runs Reset().Execute() once per var set, applying the vars
+// after each reset. Each result gets its own copy of the context. The engine
+// is left in the state of the last run.
+func (e *FeeEngine) ExecuteBatch(batch []map[string]interface{}) ([]*ExecuteResult, error) {
+	results := make([]*ExecuteResult, 0, len(batch))
+	for i, vars := range batch {
+		e.Reset()
+		for k, v := range vars {
+			e.ctx.setVar(k, v)
+		}
+		result, err := e.Execute()
 		if err != nil {
-			return nil, fmt.Errorf("error executing rule at index %d: %w", i, err)
+			return nil, fmt.Errorf("batch item %d: %w", i, err)
 		}
+		result.Context = e.ctx.Copy()
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// processRule executes the rule at index i and records its fee items, var
+// updates and log entry on the context
+func (e *FeeEngine) processRule(i int) error {
+	rule := e.rules[i].expr
 
-		// Process rule result: add fee items and update context
-		var ruleFeeItems []FeeItem
-		if result != nil {
-			if len(result.FeeItems) > 0 {
-				ruleFeeItems = make([]FeeItem, len(result.FeeItems))
-				copy(ruleFeeItems, result.FeeItems)
-				for _, item := range result.FeeItems {
-					e.ctx.addFeeItem(item)
+	result, err := e.executeRule(i)
+	if err != nil {
+		return fmt.Errorf("error executing rule at index %d: %w", i, withRule(err, i, rule))
+	}
+
+	// Process rule result: add fee items and update context
+	var ruleFeeItems []FeeItem
+	if result != nil {
+		if len(result.FeeItems) > 0 {
+			ruleFeeItems = make([]FeeItem, len(result.FeeItems))
+			copy(ruleFeeItems, result.FeeItems)
+			if e.opts.reversing && !e.keepReverseSign {
+				for j := range ruleFeeItems {
+					ruleFeeItems[j].Amount = ruleFeeItems[j].Amount.Neg()
 				}
 			}
-			if result.Context != nil {
-				for k, v := range result.Context.Vars {
-					e.ctx.setVar(k, v)
+			if e.interceptor != nil {
+				for j, item := range ruleFeeItems {
+					ruleFeeItems[j], err = e.interceptor(item)
+					if err != nil {
+						return fmt.Errorf("fee item rejected at rule index %d: %w", i, err)
+					}
 				}
 			}
+			if e.maxFeeItems > 0 {
+				e.ctx.mu.RLock()
+				total := len(e.ctx.FeeItems) + len(ruleFeeItems)
+				e.ctx.mu.RUnlock()
+				if total > e.maxFeeItems {
+					return fmt.Errorf("rule at index %d would produce %d fee items, limit is %d: %w", i, total, e.maxFeeItems, ErrMaxFeeItems)
+				}
+			}
+			for _, item := range ruleFeeItems {
+				if e.dropZeroFees && item.Amount.IsZero() {
+					continue
+				}
+				if e.stream != nil {
+					if err := e.stream(item); err != nil {
+						return fmt.Errorf("fee item stream aborted at rule index %d: %w", i, err)
+					}
+					continue
+				}
+				e.ctx.addFeeItem(item)
+			}
+		}
+		if result.Context != nil {
+			for k, v := range result.Context.Vars {
+				e.ctx.setVar(k, v)
+			}
 		}
+		if len(result.Warnings) > 0 {
+			e.ctx.addWarnings(result.Warnings)
+		}
+	}
 
-		// Log entry (only if logging is enabled)
-		if e.ctx.enableLog {
+	// Log entry (only if logging is enabled or a log writer is set)
+	if e.ctx.enableLog || e.logWriter != nil {
+		entry := Log{
+			Rule:     rule,
+			FeeItems: ruleFeeItems,
+			TxID:     e.ctx.TxID,
+		}
+		if e.logLevel == LogLevelFull {
 			e.ctx.mu.RLock()
-			varsAfter := make(map[string]interface{})
+			entry.Vars = make(map[string]interface{}, len(e.ctx.Vars))
 			for k, v := range e.ctx.Vars {
-				varsAfter[k] = v
+				entry.Vars[k] = logValue(v)
 			}
 			e.ctx.mu.RUnlock()
-
-			e.ctx.addLog(Log{
-				Rule:     rule,
-				Vars:     varsAfter,
-				FeeItems: ruleFeeItems,
-			})
 		}
+		if preprocessed := preprocessExpression(rule); !isNote(rule) && preprocessed != rule {
+			entry.Preprocessed = preprocessed
+		}
+		if e.ctx.enableLog {
+			e.ctx.addLog(entry)
+		}
+		if e.logWriter != nil {
+			if err := e.writeLog(entry); err != nil {
+				return fmt.Errorf("error writing log for rule at index %d: %w", i, err)
+			}
+		}
+	}
 
-		processed++
+	if e.rules[i].final || (result != nil && result.Halt) {
+		e.ctx.halted = true
 	}
+	return nil
+}
 
-	e.ctx.lastExecutedRule = endIndex
-	return e.buildExecuteResult(processed)
+// writeLog writes a log entry as a single JSON line to the log writer
+func (e *FeeEngine) writeLog(entry Log) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := e.logWriter.Write(line); err != nil {
+		return err
+	}
+	if f, ok := e.logWriter.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
 }
 
 // buildExecuteResult builds an ExecuteResult from current context state
@@ -197,10 +1096,35 @@ func (e *FeeEngine) buildExecuteResult(processed int) (*ExecuteResult, error) {
 	defer e.ctx.mu.RUnlock()
 
 	summary := e.summarizeFeeItems(e.ctx.FeeItems)
+	if e.expectedCurrencies != nil {
+		for _, item := range summary {
+			if !e.expectedCurrencies[item.Currency] {
+				return nil, fmt.Errorf("unexpected currency in summary: %q", item.Currency)
+			}
+		}
+	}
 	feeItems := make([]FeeItem, len(e.ctx.FeeItems))
 	copy(feeItems, e.ctx.FeeItems)
 	logs := make([]Log, len(e.ctx.Logs))
 	copy(logs, e.ctx.Logs)
+	var warnings []string
+	if len(e.ctx.Warnings) > 0 {
+		warnings = make([]string, len(e.ctx.Warnings))
+		copy(warnings, e.ctx.Warnings)
+	}
+
+	if e.rounding {
+		e.roundFeeItems(feeItems, summary)
+	}
+	if e.summaryMultiplier != nil {
+		for i := range summary {
+			summary[i].Amount = summary[i].Amount.Mul(*e.summaryMultiplier)
+			if e.rounding {
+				summary[i].Amount = summary[i].Amount.Round(e.roundingPlaces(summary[i].Currency))
+			}
+		}
+	}
+	summary = normalizeSummary(summary, !e.keepZeroSummary)
 
 	return &ExecuteResult{
 		ProcessedRules: processed,
@@ -208,34 +1132,217 @@ func (e *FeeEngine) buildExecuteResult(processed int) (*ExecuteResult, error) {
 		Summary:        summary,
 		Context:        e.ctx,
 		Logs:           logs,
+		Warnings:       warnings,
+		Halted:         e.ctx.halted,
+		TxID:           e.ctx.TxID,
+		rates:          e.opts.rates,
+		currencies:     e.currencyTable,
+		baseVar:        e.opts.base(),
 	}, nil
 }
 
+// roundFeeItems rounds fee items and summary lines in place, allocating
+// rounding residuals to the largest item per currency if enabled
+func (e *FeeEngine) roundFeeItems(items []FeeItem, summary []FeeItem) {
+	roundedSums := make(map[Currency]decimal.Decimal)
+	largest := make(map[Currency]int)
+	for i := range items {
+		items[i].Amount = items[i].Amount.Round(e.roundingPlaces(items[i].Currency))
+		currency := items[i].Currency
+		roundedSums[currency] = roundedSums[currency].Add(items[i].Amount)
+		if j, ok := largest[currency]; !ok || items[i].Amount.Abs().GreaterThan(items[j].Amount.Abs()) {
+			largest[currency] = i
+		}
+	}
+
+	for i := range summary {
+		summary[i].Amount = summary[i].Amount.Round(e.roundingPlaces(summary[i].Currency))
+		if !e.allocateResidual {
+			continue
+		}
+		currency := summary[i].Currency
+		residual := summary[i].Amount.Sub(roundedSums[currency])
+		if j, ok := largest[currency]; ok && !residual.IsZero() {
+			items[j].Amount = items[j].Amount.Add(residual)
+		}
+	}
+}
+
+// logValue returns v as recorded in a log snapshot. *decimal.Decimal vars are
+// recorded by value so later changes do not alias into the log; other values,
+// including decimals and float32, are kept as is. Log.MarshalJSON normalizes
+// decimals when the log is serialized.
+func logValue(v interface{}) interface{} {
+	if d, ok := v.(*decimal.Decimal); ok {
+		if d == nil {
+			return nil
+		}
+		return *d
+	}
+	return v
+}
+
 // executeRule executes a single rule and returns the result
-func (e *FeeEngine) executeRule(rule string) (*RuleResult, error) {
-	return executeExpression(rule, e.ctx)
+func (e *FeeEngine) executeRule(i int) (*RuleResult, error) {
+	return executeExpression(e.rules[i].expr, e.ctx, &e.opts, i, e.rules[i].name)
+}
+
+// NormalizeSummary folds summary lines of the same currency into one, keeping
+// the first line's position and the tags all folded lines share, and drops
+// lines whose amount is zero
+func NormalizeSummary(items []FeeItem) []FeeItem {
+	return normalizeSummary(items, true)
 }
 
-// summarizeFeeItems summarizes fee items by currency
+func normalizeSummary(items []FeeItem, dropZero bool) []FeeItem {
+	index := make(map[Currency]int, len(items))
+	folded := make([]FeeItem, 0, len(items))
+	for _, item := range items {
+		j, ok := index[item.Currency]
+		if !ok {
+			index[item.Currency] = len(folded)
+			folded = append(folded, item)
+			continue
+		}
+		folded[j].Amount = folded[j].Amount.Add(item.Amount)
+		folded[j].Tags = sharedTags(folded[j].Tags, item.Tags)
+	}
+	if !dropZero {
+		return folded
+	}
+	out := folded[:0]
+	for _, item := range folded {
+		if !item.Amount.IsZero() {
+			out = append(out, item)
+		}
+	}
+	return out
+}
+
+// sharedTags returns the tags present with the same value in both maps
+func sharedTags(a, b map[string]string) map[string]string {
+	var shared map[string]string
+	for k, v := range a {
+		if b[k] == v {
+			if shared == nil {
+				shared = make(map[string]string)
+			}
+			shared[k] = v
+		}
+	}
+	return shared
+}
+
+// summarizeFeeItems summarizes fee items by currency, in order of each
+// currency's first appearance
 func (e *FeeEngine) summarizeFeeItems(items []FeeItem) []FeeItem {
-	currencyMap := make(map[string]decimal.Decimal)
+	currencyMap := make(map[Currency]decimal.Decimal)
+	order := make([]Currency, 0)
 	for _, item := range items {
+		if _, ok := currencyMap[item.Currency]; !ok {
+			order = append(order, item.Currency)
+		}
 		currencyMap[item.Currency] = currencyMap[item.Currency].Add(item.Amount)
 	}
 
 	summary := make([]FeeItem, 0, len(currencyMap))
-	for currency, amount := range currencyMap {
+	for _, currency := range order {
 		summary = append(summary, FeeItem{
-			Amount:   amount,
+			Amount:   currencyMap[currency],
 			Currency: currency,
 		})
 	}
+
+	if e.summaryTags {
+		for i := range summary {
+			summary[i].Tags = commonTags(items, summary[i].Currency)
+		}
+	}
 	return summary
 }
 
+// commonTags returns the tags shared with the same value by every item of the
+// given currency, or nil if there are none
+func commonTags(items []FeeItem, currency Currency) map[string]string {
+	var tags map[string]string
+	first := true
+	for _, item := range items {
+		if item.Currency != currency {
+			continue
+		}
+		if first {
+			tags = make(map[string]string, len(item.Tags))
+			for k, v := range item.Tags {
+				tags[k] = v
+			}
+			first = false
+			continue
+		}
+		for k, v := range tags {
+			if item.Tags[k] != v {
+				delete(tags, k)
+			}
+		}
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+	return tags
+}
+
+// Validate dry-runs all rules on a copy of the context and reports every rule
+// that fails to compile or run, or whose result can never be a fee item, such
+// as `amount > 5`. Rules turned off by AddRuleIf are skipped, as in Execute.
+// The engine's state is left untouched.
+func (e *FeeEngine) Validate() error {
+	_, err := e.dryRun()
+	return err
+}
+
+// dryRun runs the rules for Validate on a copy of the engine and returns the
+// env vars each rule read, keyed by rule index
+func (e *FeeEngine) dryRun() (map[int][]string, error) {
+	disabled, err := e.disabledRules()
+	if err != nil {
+		return nil, err
+	}
+
+	dry := *e
+	dry.ctx = e.ctx.Copy()
+	dry.ctx.FeeItems = make([]FeeItem, 0)
+	dry.ctx.Logs = make([]Log, 0)
+	dry.ctx.lastExecutedRule = 0
+	dry.logWriter = nil
+	dry.interceptor = nil
+	dry.opts.checkTypes = true
+	dry.opts.deps = make(map[int][]string)
+	dry.opts.rng = nil
+	if e.seeded {
+		dry.opts.rng = rand.New(rand.NewSource(e.seed))
+	}
+
+	var errs []error
+	for i := range dry.rules {
+		if dry.ctx.halted {
+			break
+		}
+		if disabled[i] {
+			continue
+		}
+		if err := dry.processRule(i); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return dry.opts.deps, errors.Join(errs...)
+}
+
 // GetRules returns all rules
 func (e *FeeEngine) GetRules() []string {
-	return e.rules
+	rules := make([]string, len(e.rules))
+	for i, r := range e.rules {
+		rules[i] = r.expr
+	}
+	return rules
 }
 
 // GetRuleCount returns the number of rules
@@ -243,6 +1350,20 @@ func (e *FeeEngine) GetRuleCount() int {
 	return len(e.rules)
 }
 
+// RemainingRules returns how many rules Execute would still run: the rules
+// after the current position, or zero once execution has halted
+func (e *FeeEngine) RemainingRules() int {
+	if e.ctx.halted || e.ctx.lastExecutedRule >= len(e.rules) {
+		return 0
+	}
+	return len(e.rules) - e.ctx.lastExecutedRule
+}
+
+// IsComplete reports whether no rules remain to execute
+func (e *FeeEngine) IsComplete() bool {
+	return e.RemainingRules() == 0
+}
+
 // GetContext returns the context
 func (e *FeeEngine) GetContext() *Context {
 	return e.ctx
@@ -1,12 +1,21 @@
 package feecalc
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/shopspring/decimal"
 )
 
-func findAmountByCurrency(items []FeeItem, currency string) decimal.Decimal {
+func findAmountByCurrency(items []FeeItem, currency Currency) decimal.Decimal {
 	for _, item := range items {
 		if item.Currency == currency {
 			return item.Amount
@@ -476,6 +485,86 @@ func TestFeeEngine_EnableLog(t *testing.T) {
 	}
 }
 
+func TestFeeEngine_MinimalLogLevel(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 1000.0,
+		},
+	}
+	engine := New(ctx).EnableLog().WithLogLevel(LogLevelMinimal)
+
+	engine.AddRule(`$(amount * 0.02, "USD")`)
+	engine.AddRule(`amount = amount * 2`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.Logs) != 2 {
+		t.Fatalf("Expected 2 log entries, got %d", len(result.Logs))
+	}
+
+	for i, log := range result.Logs {
+		if log.Vars != nil {
+			t.Errorf("Expected log %d to omit vars, got %v", i, log.Vars)
+		}
+	}
+
+	if len(result.Logs[0].FeeItems) != 1 {
+		t.Errorf("Expected 1 fee item in first log, got %d", len(result.Logs[0].FeeItems))
+	}
+}
+
+func benchmarkLogLevel(b *testing.B, level LogLevel) {
+	vars := make(map[string]interface{}, 50)
+	for i := 0; i < 50; i++ {
+		vars[fmt.Sprintf("var_%d", i)] = float64(i)
+	}
+	engine := New(&Context{Vars: vars}).EnableLog().WithLogLevel(level)
+	for i := 0; i < 10; i++ {
+		engine.AddRule(fmt.Sprintf(`$(var_%d * 0.01, "USD")`, i))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := engine.Reset().Execute(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFeeEngine_LogLevelFull(b *testing.B) {
+	benchmarkLogLevel(b, LogLevelFull)
+}
+
+func BenchmarkFeeEngine_LogLevelMinimal(b *testing.B) {
+	benchmarkLogLevel(b, LogLevelMinimal)
+}
+
+func TestFeeEngine_ExecuteContextCancelled(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(1.0, "USD")`, `$(2.0, "USD")`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := engine.ExecuteContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if result.ProcessedRules != 2 {
+		t.Errorf("Expected remaining 2 rules to run, got %d", result.ProcessedRules)
+	}
+}
+
 func TestFeeEngine_EmptyRules(t *testing.T) {
 	ctx := &Context{
 		Vars:     make(map[string]interface{}),
@@ -1193,3 +1282,2482 @@ func TestFeeEngine_ResetMultipleTimes(t *testing.T) {
 		}
 	}
 }
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestFeeEngine_LogWriter(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 1000.0,
+			"rate":   0.02,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	var buf bytes.Buffer
+	engine := New(ctx).WithLogWriter(&buf)
+
+	engine.AddRule(`$(amount * rate, "USD")`)
+	engine.AddRule(`amount = amount * 2`)
+	engine.AddRule(`$(amount * rate, "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	// Logs are streamed, not kept in memory
+	if len(result.Logs) != 0 {
+		t.Errorf("Expected 0 in-memory log entries, got %d", len(result.Logs))
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 NDJSON lines, got %d", len(lines))
+	}
+
+	var entry Log
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("Failed to decode log line: %v", err)
+	}
+	if entry.Rule != `amount = amount * 2` {
+		t.Errorf("Expected second log rule to match, got %s", entry.Rule)
+	}
+}
+
+func TestFeeEngine_LogWriterError(t *testing.T) {
+	engine := New(nil).WithLogWriter(failingWriter{})
+	engine.AddRule(`$(10.0, "USD")`)
+
+	_, err := engine.Execute()
+	if err == nil {
+		t.Fatal("Expected error from failing log writer, but got nil")
+	}
+
+	if !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("Expected wrapped writer error, got %v", err)
+	}
+}
+
+func TestFeeEngine_GetVarDecimal(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"count":  3,
+			"amount": 100.1,
+			"rate":   0.015,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx)
+
+	engine.AddRule(`fee = Mul(amount, rate)`)
+
+	if _, err := engine.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	count, ok := engine.GetVarDecimal("count")
+	if !ok {
+		t.Fatal("Expected count to be present")
+	}
+	if !count.Equal(decimal.NewFromInt(3)) {
+		t.Errorf("Expected count 3, got %s", count.String())
+	}
+
+	fee, ok := engine.GetVarDecimal("fee")
+	if !ok {
+		t.Fatal("Expected fee to be present")
+	}
+	if !fee.Equal(decimal.RequireFromString("1.5015")) {
+		t.Errorf("Expected fee 1.5015, got %s", fee.String())
+	}
+
+	if _, ok := engine.GetVarDecimal("missing"); ok {
+		t.Error("Expected missing var to return false")
+	}
+
+	engine.SetVar("currency", "USD").SetVar("vip", true).SetVar("price", "12.50")
+	for _, name := range []string{"currency", "vip"} {
+		if _, ok := engine.GetVarDecimal(name); ok {
+			t.Errorf("Expected non-numeric var %s to return false", name)
+		}
+	}
+	if price, ok := engine.GetVarDecimal("price"); !ok || !price.Equal(decimal.RequireFromString("12.5")) {
+		t.Errorf("Expected numeric string price 12.5, got %s (%v)", price.String(), ok)
+	}
+}
+
+func TestFeeEngine_ExpectedCurrencies(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount":   1000.0,
+			"currency": "USDT",
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx).WithExpectedCurrencies([]string{"USD", "EUR"})
+
+	engine.AddRule(`$(10.0, "USD")`)
+	engine.AddRule(`$(amount * 0.01, currency)`)
+
+	_, err := engine.Execute()
+	if err == nil {
+		t.Fatal("Expected error for unexpected currency, but got nil")
+	}
+
+	if !strings.Contains(err.Error(), "USDT") {
+		t.Errorf("Expected error to name the stray currency, got %v", err)
+	}
+
+	clean := New(nil).WithExpectedCurrencies([]string{"USD", "EUR"})
+	clean.AddRule(`[$(10.0, "USD"), $(20.0, "EUR")]`)
+
+	if _, err := clean.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+}
+
+func TestFeeEngine_NestedExpressionArray(t *testing.T) {
+	engine := New(nil)
+
+	engine.AddRule(`[["$(1, \"USD\")"], "$(2, \"USD\")"]`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.FeeItems) != 2 {
+		t.Fatalf("Expected 2 fee items, got %d", len(result.FeeItems))
+	}
+
+	usdAmount := findAmountByCurrency(result.Summary, "USD")
+	if !usdAmount.Equal(decimal.NewFromInt(3)) {
+		t.Errorf("Expected USD summary 3, got %s", usdAmount.String())
+	}
+}
+
+func TestFeeEngine_DistributeDiscount(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`[$(10.0, "USD"), $(20.0, "USD"), $(30.0, "USD"), $(40.0, "EUR")]`)
+
+	if _, err := engine.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	engine.DistributeDiscount(30, "USD")
+
+	items := engine.GetContext().FeeItems
+	expected := []string{"5", "10", "15", "40"}
+	for i, want := range expected {
+		if !items[i].Amount.Equal(decimal.RequireFromString(want)) {
+			t.Errorf("Expected item %d amount %s, got %s", i, want, items[i].Amount.String())
+		}
+	}
+}
+
+func TestFeeEngine_DistributeDiscountExceedsTotal(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`[$(10.0, "USD"), $(20.0, "USD")]`)
+
+	if _, err := engine.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	engine.DistributeDiscount(100, "USD")
+
+	for i, item := range engine.GetContext().FeeItems {
+		if !item.Amount.IsZero() {
+			t.Errorf("Expected item %d capped at zero, got %s", i, item.Amount.String())
+		}
+	}
+}
+
+func TestFeeEngine_AllowEmptyRules(t *testing.T) {
+	if _, err := New(nil).WithAllowEmptyRules(false).Execute(); err == nil {
+		t.Fatal("Expected error when no rules, but got nil")
+	}
+
+	result, err := New(nil).WithAllowEmptyRules(true).Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if result.ProcessedRules != 0 {
+		t.Errorf("Expected 0 processed rules, got %d", result.ProcessedRules)
+	}
+
+	if len(result.Summary) != 0 {
+		t.Errorf("Expected empty summary, got %d lines", len(result.Summary))
+	}
+}
+
+func TestFeeEngine_Profile(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(10.0, "USD")`)
+	engine.AddRule(`$(20.0, "USD")`)
+
+	for i := 0; i < 3; i++ {
+		if _, err := engine.Reset().Execute(); err != nil {
+			t.Fatalf("Execute failed on iteration %d: %v", i, err)
+		}
+	}
+
+	report := engine.Profile()
+	if report.Runs != 3 {
+		t.Errorf("Expected 3 runs, got %d", report.Runs)
+	}
+
+	if report.ProcessedRules != 6 {
+		t.Errorf("Expected 6 processed rules, got %d", report.ProcessedRules)
+	}
+
+	if report.AvgRulesPerRun != 2 {
+		t.Errorf("Expected 2 rules per run, got %f", report.AvgRulesPerRun)
+	}
+
+	if engine.ResetProfile().Profile().Runs != 0 {
+		t.Error("Expected 0 runs after ResetProfile")
+	}
+}
+
+func TestFeeEngine_MultiLineRule(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 1000.0,
+			"rate":   0.02,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx)
+
+	engine.AddRule(`amount = amount * 2
+rate = rate + 0.01
+$(amount * rate, "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.FeeItems) != 1 {
+		t.Fatalf("Expected 1 fee item, got %d", len(result.FeeItems))
+	}
+
+	expectedAmount := decimal.NewFromFloat(60.0)
+	if !result.FeeItems[0].Amount.Equal(expectedAmount) {
+		t.Errorf("Expected fee amount 60.0, got %s", result.FeeItems[0].Amount.String())
+	}
+
+	rate, _ := engine.GetVar("rate")
+	if rate.(float64) != 0.03 {
+		t.Errorf("Expected rate 0.03, got %v", rate)
+	}
+}
+
+func TestFeeEngine_MultiLineWrappedTernary(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"amount": 1000.0}})
+	engine.AddRule("amount > 1000\n  ? $(amount * 0.01, \"USD\")\n  : $(amount * 0.02, \"USD\")")
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(result.FeeItems) != 1 {
+		t.Fatalf("Expected 1 fee item, got %d", len(result.FeeItems))
+	}
+	if !result.FeeItems[0].Amount.Equal(decimal.NewFromInt(20)) {
+		t.Errorf("Expected fee amount 20, got %s", result.FeeItems[0].Amount.String())
+	}
+}
+
+func TestFeeEngine_MultiLineWrappedBinary(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"amount": 1000.0}})
+	engine.AddRule(`fee = amount * 0.01 +
+  5
+$(fee
+  * 2, "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(result.FeeItems) != 1 {
+		t.Fatalf("Expected 1 fee item, got %d", len(result.FeeItems))
+	}
+	if !result.FeeItems[0].Amount.Equal(decimal.NewFromInt(30)) {
+		t.Errorf("Expected fee amount 30, got %s", result.FeeItems[0].Amount.String())
+	}
+}
+
+func TestFeeEngine_SemicolonInStringLiteral(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"amount": 100.0}})
+	engine.AddRule(`Warn("check; later"); $(amount * 0.01, "USD")`)
+	engine.AddRule(`Repeat(2, "fee = 1; $(fee, \"EUR\")")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(result.Warnings) != 1 || !strings.Contains(result.Warnings[0], "check; later") {
+		t.Errorf("Expected warning \"check; later\", got %v", result.Warnings)
+	}
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(1)) {
+		t.Errorf("Expected USD total 1, got %s", amount.String())
+	}
+	if amount := findAmountByCurrency(result.Summary, "EUR"); !amount.Equal(decimal.NewFromInt(2)) {
+		t.Errorf("Expected EUR total 2, got %s", amount.String())
+	}
+}
+
+func TestFeeEngine_Constants(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 1000.0,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx).WithConstants(map[string]interface{}{
+		"platform_base": 5.0,
+	})
+
+	engine.AddRule(`$(amount * 0.01 + platform_base, "USD")`)
+
+	for i := 0; i < 2; i++ {
+		result, err := engine.Reset().Execute()
+		if err != nil {
+			t.Fatalf("Execute failed on iteration %d: %v", i, err)
+		}
+
+		usdAmount := findAmountByCurrency(result.Summary, "USD")
+		if !usdAmount.Equal(decimal.NewFromFloat(15.0)) {
+			t.Errorf("Expected USD summary 15.0 on iteration %d, got %s", i, usdAmount.String())
+		}
+	}
+
+	if _, ok := engine.GetVar("platform_base"); ok {
+		t.Error("Expected constant to stay out of context vars")
+	}
+}
+
+func TestFeeEngine_ConstantsReadOnly(t *testing.T) {
+	engine := New(nil).WithConstants(map[string]interface{}{
+		"platform_base": 5.0,
+	})
+
+	engine.AddRule(`platform_base = 10`)
+
+	if _, err := engine.Execute(); err == nil {
+		t.Fatal("Expected error assigning to a constant, but got nil")
+	}
+}
+
+func TestFeeEngine_ResidualAllocation(t *testing.T) {
+	rule := `[$(1.335, "USD"), $(3.335, "USD"), $(2.335, "USD")]`
+
+	naive, err := New(nil).WithRounding(2).AddRule(rule).Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	naiveSum := decimal.Zero
+	for _, item := range naive.FeeItems {
+		naiveSum = naiveSum.Add(item.Amount)
+	}
+	if naiveSum.Equal(naive.Summary[0].Amount) {
+		t.Fatalf("Expected naive rounding to drift, got %s for both", naiveSum.String())
+	}
+
+	result, err := New(nil).WithRounding(2).WithResidualAllocation(true).AddRule(rule).Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	expected := []string{"1.34", "3.33", "2.34"}
+	sum := decimal.Zero
+	for i, want := range expected {
+		if !result.FeeItems[i].Amount.Equal(decimal.RequireFromString(want)) {
+			t.Errorf("Expected item %d amount %s, got %s", i, want, result.FeeItems[i].Amount.String())
+		}
+		sum = sum.Add(result.FeeItems[i].Amount)
+	}
+
+	if !sum.Equal(result.Summary[0].Amount) {
+		t.Errorf("Expected items to reconcile with summary %s, got %s", result.Summary[0].Amount.String(), sum.String())
+	}
+}
+
+func TestFeeEngine_NoteRule(t *testing.T) {
+	engine := New(nil).EnableLog()
+
+	engine.AddRule(`# -- begin platform fees --`)
+	engine.AddRule(`$(10.0, "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if result.ProcessedRules != 2 {
+		t.Errorf("Expected 2 processed rules, got %d", result.ProcessedRules)
+	}
+
+	if len(result.Logs) != 2 {
+		t.Fatalf("Expected 2 log entries, got %d", len(result.Logs))
+	}
+
+	if result.Logs[0].Rule != `# -- begin platform fees --` {
+		t.Errorf("Expected note text in log, got %s", result.Logs[0].Rule)
+	}
+
+	if len(result.Logs[0].FeeItems) != 0 {
+		t.Errorf("Expected note to produce no fee items, got %d", len(result.Logs[0].FeeItems))
+	}
+
+	if len(result.FeeItems) != 1 {
+		t.Errorf("Expected 1 fee item, got %d", len(result.FeeItems))
+	}
+}
+
+func TestFeeEngine_DecimalVars(t *testing.T) {
+	amount, err := decimal.NewFromString("10000.005")
+	if err != nil {
+		t.Fatalf("Failed to parse amount: %v", err)
+	}
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount":       amount,
+			"float_amount": 10000.005,
+			"rate":         decimal.RequireFromString("0.015"),
+			"float_rate":   0.015,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx)
+
+	engine.AddRule(`$(Mul(amount, rate), "USD")`)
+	engine.AddRule(`$(float_amount * float_rate, "EUR")`)
+	engine.AddRule(`amount > 10000 ? $(amount * rate, "GBP") : nil`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	expected := decimal.RequireFromString("150.000075")
+	usdAmount := findAmountByCurrency(result.Summary, "USD")
+	if !usdAmount.Equal(expected) {
+		t.Errorf("Expected USD summary %s, got %s", expected.String(), usdAmount.String())
+	}
+
+	// The float path loses precision
+	eurAmount := findAmountByCurrency(result.Summary, "EUR")
+	if eurAmount.Equal(expected) {
+		t.Errorf("Expected float path to lose precision, got %s", eurAmount.String())
+	}
+
+	// Operators on decimal vars stay decimal
+	gbpAmount := findAmountByCurrency(result.Summary, "GBP")
+	if !gbpAmount.Equal(expected) {
+		t.Errorf("Expected GBP summary %s, got %s", expected.String(), gbpAmount.String())
+	}
+}
+
+func TestFeeEngine_DecimalOperators(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{
+		"amount": decimal.RequireFromString("100.10"),
+		"fixed":  decimal.RequireFromString("0.30"),
+	}})
+	engine.AddRule(`$(amount * 0.029 + fixed, "USD")`)
+	engine.AddRule(`$(amount - 100, "EUR")`)
+	engine.AddRule(`$(amount / 4, "GBP")`)
+	engine.AddRule(`amount >= 100.1 ? $(1, "KES") : nil`)
+	engine.AddRule(`amount == 100.1 && amount != fixed ? $(2, "JPY") : nil`)
+	engine.AddRule(`$(-fixed, "CHF")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	expected := map[string]string{"USD": "3.2029", "EUR": "0.1", "GBP": "25.025", "KES": "1", "JPY": "2", "CHF": "-0.3"}
+	for currency, want := range expected {
+		got := findAmountByCurrency(result.Summary, Currency(currency))
+		if !got.Equal(decimal.RequireFromString(want)) {
+			t.Errorf("Expected %s summary %s, got %s", currency, want, got.String())
+		}
+	}
+
+	engine = New(&Context{Vars: map[string]interface{}{"amount": decimal.NewFromInt(1)}})
+	engine.AddRule(`$(amount / 0, "USD")`)
+	if _, err := engine.Execute(); err == nil {
+		t.Error("Expected division by zero error")
+	}
+}
+
+func TestFeeEngine_DecimalVarsAfterReset(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{
+		"amount": decimal.RequireFromString("10000.005"),
+		"rate":   decimal.RequireFromString("0.015"),
+	}})
+	engine.AddRule(`amount = amount * 2`, `$(amount * rate, "USD")`)
+
+	for i := 0; i < 2; i++ {
+		result, err := engine.Reset().Execute()
+		if err != nil {
+			t.Fatalf("run %d: Execute failed: %v", i, err)
+		}
+		if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.RequireFromString("300.00015")) {
+			t.Errorf("run %d: expected USD total 300.00015, got %s", i, amount.String())
+		}
+	}
+
+	amount, _ := engine.Reset().GetVar("amount")
+	if d, ok := amount.(decimal.Decimal); !ok || !d.Equal(decimal.RequireFromString("10000.005")) {
+		t.Errorf("Expected Reset to restore the decimal amount, got %#v", amount)
+	}
+}
+
+func TestFeeEngine_SetVarString(t *testing.T) {
+	engine := New(nil)
+
+	if err := engine.SetVarString("a", "0.1"); err != nil {
+		t.Fatalf("SetVarString failed: %v", err)
+	}
+	engine.SetVarDecimal("b", decimal.RequireFromString("0.2"))
+
+	engine.AddRule(`$(Add(a, b), "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	usdAmount := findAmountByCurrency(result.Summary, "USD")
+	if usdAmount.String() != "0.3" {
+		t.Errorf("Expected USD summary exactly 0.3, got %s", usdAmount.String())
+	}
+
+	if err := engine.SetVarString("c", "abc"); err == nil {
+		t.Error("Expected error for non-numeric string, but got nil")
+	}
+}
+
+func TestFeeEngine_FeeItemInterceptor(t *testing.T) {
+	rounder := func(item FeeItem) (FeeItem, error) {
+		item.Amount = item.Amount.Round(2)
+		return item, nil
+	}
+
+	result, err := New(nil).WithFeeItemInterceptor(rounder).EnableLog().
+		AddRule(`$(10.456, "USD")`, `$(1.004, "USD")`).
+		Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if !result.FeeItems[0].Amount.Equal(decimal.RequireFromString("10.46")) {
+		t.Errorf("Expected rounded amount 10.46, got %s", result.FeeItems[0].Amount.String())
+	}
+
+	if !result.Logs[1].FeeItems[0].Amount.Equal(decimal.RequireFromString("1")) {
+		t.Errorf("Expected log to carry rounded amount 1, got %s", result.Logs[1].FeeItems[0].Amount.String())
+	}
+
+	sanityCap := decimal.NewFromInt(1000000)
+	capper := func(item FeeItem) (FeeItem, error) {
+		if item.Amount.GreaterThan(sanityCap) {
+			return item, fmt.Errorf("fee %s exceeds sanity cap", item.Amount.String())
+		}
+		return item, nil
+	}
+
+	_, err = New(nil).WithFeeItemInterceptor(capper).
+		AddRule(`$(100.0, "USD")`, `$(2000000, "USD")`).
+		Execute()
+	if err == nil {
+		t.Fatal("Expected error for fee above sanity cap, but got nil")
+	}
+
+	if !strings.Contains(err.Error(), "rule index 1") {
+		t.Errorf("Expected error to name rule index 1, got %v", err)
+	}
+}
+
+func TestFeeEngine_NetCascade(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 1000.0,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx)
+
+	engine.AddRule(`$(Mul(Net("USD"), 0.02), "USD")`)
+	engine.AddRule(`$(Mul(Net("USD"), 0.02), "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	expected := []string{"20", "19.6"}
+	for i, want := range expected {
+		if !result.FeeItems[i].Amount.Equal(decimal.RequireFromString(want)) {
+			t.Errorf("Expected item %d amount %s, got %s", i, want, result.FeeItems[i].Amount.String())
+		}
+	}
+}
+
+func TestFeeEngine_NetCustomBaseVar(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"principal": 500,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx).WithBaseVar("principal")
+
+	engine.AddRule(`$(100, "USD")`, `$(Mul(Net("USD"), 0.1), "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if !result.FeeItems[1].Amount.Equal(decimal.NewFromInt(40)) {
+		t.Errorf("Expected fee 40, got %s", result.FeeItems[1].Amount.String())
+	}
+}
+
+func TestFeeEngine_LogPreprocessed(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"b": 2.0,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx).EnableLog()
+
+	engine.AddRule(`a = b*2`)
+	engine.AddRule(`$(a, "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if result.Logs[0].Rule != `a = b*2` {
+		t.Errorf("Expected original rule in log, got %s", result.Logs[0].Rule)
+	}
+
+	if result.Logs[0].Preprocessed != `Set("a", b*2)` {
+		t.Errorf("Expected preprocessed rule in log, got %s", result.Logs[0].Preprocessed)
+	}
+
+	if result.Logs[1].Preprocessed != "" {
+		t.Errorf("Expected no preprocessed form when unchanged, got %s", result.Logs[1].Preprocessed)
+	}
+}
+
+func TestFeeEngine_Split(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`Split(100, "USD", {"platform": 0.7, "merchant": 0.3})`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.FeeItems) != 2 {
+		t.Fatalf("Expected 2 fee items, got %d", len(result.FeeItems))
+	}
+
+	byLabel := make(map[string]decimal.Decimal)
+	for _, item := range result.FeeItems {
+		byLabel[item.Label] = item.Amount
+	}
+
+	if !byLabel["platform"].Equal(decimal.NewFromInt(70)) {
+		t.Errorf("Expected platform share 70, got %s", byLabel["platform"].String())
+	}
+
+	if !byLabel["merchant"].Equal(decimal.NewFromInt(30)) {
+		t.Errorf("Expected merchant share 30, got %s", byLabel["merchant"].String())
+	}
+
+	usdAmount := findAmountByCurrency(result.Summary, "USD")
+	if !usdAmount.Equal(decimal.NewFromInt(100)) {
+		t.Errorf("Expected shares to reconcile to 100, got %s", usdAmount.String())
+	}
+}
+
+func TestFeeEngine_SplitResidual(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`Split(100, "USD", {"a": 0.3333333333333333, "b": 0.3333333333333333, "c": 0.3333333333333334})`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	usdAmount := findAmountByCurrency(result.Summary, "USD")
+	if !usdAmount.Equal(decimal.NewFromInt(100)) {
+		t.Errorf("Expected shares to reconcile to 100, got %s", usdAmount.String())
+	}
+
+	if !result.FeeItems[2].Amount.Equal(decimal.RequireFromString("33.34")) {
+		t.Errorf("Expected residual on largest share c, got %s", result.FeeItems[2].Amount.String())
+	}
+
+	if _, err := New(nil).AddRule(`Split(100, "USD", {"a": 0.5})`).Execute(); err == nil {
+		t.Error("Expected error for weights not summing to 1, but got nil")
+	}
+}
+
+func TestFeeEngine_ExecuteReverse(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 1000.0,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx).EnableLog()
+
+	engine.AddRule(`$(amount * 0.01, "USD")`)
+	engine.AddRule(`$(5.0, "USD")`)
+	engine.AddRule(`Reversing() ? nil : $(2.0, "EUR")`)
+
+	forward, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	forwardUSD := findAmountByCurrency(forward.Summary, "USD")
+
+	reverse, err := engine.ExecuteReverse()
+	if err != nil {
+		t.Fatalf("ExecuteReverse failed: %v", err)
+	}
+
+	reverseUSD := findAmountByCurrency(reverse.Summary, "USD")
+	if !reverseUSD.Equal(forwardUSD.Neg()) {
+		t.Errorf("Expected reverse USD summary %s, got %s", forwardUSD.Neg().String(), reverseUSD.String())
+	}
+
+	if len(reverse.FeeItems) != 2 {
+		t.Errorf("Expected EUR rule to be skipped when reversing, got %d items", len(reverse.FeeItems))
+	}
+
+	if reverse.Logs[0].Rule != `Reversing() ? nil : $(2.0, "EUR")` {
+		t.Errorf("Expected last rule to run first, got %s", reverse.Logs[0].Rule)
+	}
+
+	kept, err := engine.WithReverseNegation(false).ExecuteReverse()
+	if err != nil {
+		t.Fatalf("ExecuteReverse failed: %v", err)
+	}
+
+	if !findAmountByCurrency(kept.Summary, "USD").Equal(forwardUSD) {
+		t.Errorf("Expected unnegated USD summary %s, got %s", forwardUSD.String(), findAmountByCurrency(kept.Summary, "USD").String())
+	}
+}
+
+func TestFeeEngine_RuleIndexAndName(t *testing.T) {
+	engine := New(nil)
+
+	engine.AddRule(`RuleIndex() == 0 ? $(25.0, "USD") : nil`)
+	engine.AddRule(`RuleIndex() == 0 ? $(25.0, "USD") : nil`)
+	engine.AddNamedRule("setup_fee", `RuleName() == "setup_fee" ? $(1.0, "EUR") : nil`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.FeeItems) != 2 {
+		t.Fatalf("Expected 2 fee items, got %d", len(result.FeeItems))
+	}
+
+	usdAmount := findAmountByCurrency(result.Summary, "USD")
+	if !usdAmount.Equal(decimal.NewFromInt(25)) {
+		t.Errorf("Expected USD summary 25, got %s", usdAmount.String())
+	}
+
+	if result.FeeItems[1].Currency != "EUR" {
+		t.Errorf("Expected named rule to emit EUR fee, got %s", result.FeeItems[1].Currency)
+	}
+}
+
+func TestFeeEngine_DefaultCurrency(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 1000.0,
+			"rate":   0.02,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx).WithDefaultCurrency("USD")
+
+	engine.AddRule(`$(amount * rate)`)
+	engine.AddRule(`$(5.0, "EUR")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	usdAmount := findAmountByCurrency(result.Summary, "USD")
+	if !usdAmount.Equal(decimal.NewFromInt(20)) {
+		t.Errorf("Expected USD summary 20, got %s", usdAmount.String())
+	}
+
+	eurAmount := findAmountByCurrency(result.Summary, "EUR")
+	if !eurAmount.Equal(decimal.NewFromInt(5)) {
+		t.Errorf("Expected EUR summary 5, got %s", eurAmount.String())
+	}
+
+	noDefault := New(nil).AddRule(`$(10.0)`)
+	if _, err := noDefault.Execute(); err == nil {
+		t.Fatal("Expected error for one-argument $ without default currency, but got nil")
+	}
+}
+
+func TestFeeEngine_Case(t *testing.T) {
+	rule := `Case([amount >= 10000, amount >= 5000, amount >= 1000], [$(-30.0, "USD"), $(-20.0, "USD"), $(-10.0, "USD")], nil)`
+
+	tests := []struct {
+		amount   float64
+		expected string
+		items    int
+	}{
+		{20000.0, "-30", 1},
+		{7500.0, "-20", 1},
+		{1000.0, "-10", 1},
+		{500.0, "0", 0},
+	}
+
+	for _, tt := range tests {
+		ctx := &Context{
+			Vars: map[string]interface{}{
+				"amount": tt.amount,
+			},
+			FeeItems: make([]FeeItem, 0),
+		}
+		result, err := New(ctx).AddRule(rule).Execute()
+		if err != nil {
+			t.Fatalf("Execute failed for amount %v: %v", tt.amount, err)
+		}
+
+		if len(result.FeeItems) != tt.items {
+			t.Errorf("Expected %d fee items for amount %v, got %d", tt.items, tt.amount, len(result.FeeItems))
+		}
+
+		usdAmount := findAmountByCurrency(result.Summary, "USD")
+		if !usdAmount.Equal(decimal.RequireFromString(tt.expected)) {
+			t.Errorf("Expected discount %s for amount %v, got %s", tt.expected, tt.amount, usdAmount.String())
+		}
+	}
+
+	mismatched := New(nil).AddRule(`Case([true, false], [$(1.0, "USD")], nil)`)
+	if _, err := mismatched.Execute(); err == nil {
+		t.Error("Expected error for mismatched lengths, but got nil")
+	}
+}
+
+func TestFeeEngine_TaggedFee(t *testing.T) {
+	engine := New(nil).EnableLog().WithSummaryTags(true)
+
+	engine.AddRule(`TaggedFee(10.0, "USD", {"tax_code": "VAT", "gl_account": 4000})`)
+	engine.AddRule(`TaggedFee(5.0, "USD", {"tax_code": "VAT", "gl_account": 4100})`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	tags := result.FeeItems[0].Tags
+	if tags["tax_code"] != "VAT" || tags["gl_account"] != "4000" {
+		t.Errorf("Expected tags to be set, got %v", tags)
+	}
+
+	if result.Logs[1].FeeItems[0].Tags["gl_account"] != "4100" {
+		t.Errorf("Expected tags in log fee items, got %v", result.Logs[1].FeeItems[0].Tags)
+	}
+
+	data, err := json.Marshal(result.FeeItems[0])
+	if err != nil {
+		t.Fatalf("Marshal failed: %v", err)
+	}
+	var decoded FeeItem
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	if decoded.Tags["tax_code"] != "VAT" {
+		t.Errorf("Expected tags to round-trip through JSON, got %v", decoded.Tags)
+	}
+
+	summaryTags := result.Summary[0].Tags
+	if summaryTags["tax_code"] != "VAT" {
+		t.Errorf("Expected shared tag on summary, got %v", summaryTags)
+	}
+	if _, ok := summaryTags["gl_account"]; ok {
+		t.Errorf("Expected conflicting tag to be dropped from summary, got %v", summaryTags)
+	}
+}
+
+func TestFeeEngine_SeededRandom(t *testing.T) {
+	run := func(seed int64) []FeeItem {
+		engine := New(nil).WithSeed(seed)
+		for i := 0; i < 10; i++ {
+			engine.AddRule(`$(RandPick([1.0, 2.0, 3.0], [0.5, 0.3, 0.2]), "USD")`)
+		}
+		engine.AddRule(`Rand() < 0.5 ? $(1.0, "EUR") : $(2.0, "EUR")`)
+
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		return result.FeeItems
+	}
+
+	first := run(42)
+	second := run(42)
+
+	for i := range first {
+		if !first[i].Amount.Equal(second[i].Amount) || first[i].Currency != second[i].Currency {
+			t.Errorf("Expected identical item %d for the same seed, got %v and %v", i, first[i], second[i])
+		}
+	}
+}
+
+func TestFeeEngine_IntegerDivisionFunctions(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     string
+		expected string
+	}{
+		{"DivCeil exact", `$(DivCeil(300, 100), "USD")`, "3"},
+		{"DivCeil partial unit", `$(DivCeil(250, 100), "USD")`, "3"},
+		{"DivCeil negative", `$(DivCeil(-250, 100), "USD")`, "-2"},
+		{"DivFloor partial unit", `$(DivFloor(250, 100), "USD")`, "2"},
+		{"DivFloor negative", `$(DivFloor(-250, 100), "USD")`, "-3"},
+		{"Mod remainder", `$(Mod(250, 100), "USD")`, "50"},
+		{"Per-unit fee", `$(Mul(DivCeil(250, 100), 0.30), "USD")`, "0.9"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := New(nil).AddRule(tt.rule).Execute()
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+
+			if !result.FeeItems[0].Amount.Equal(decimal.RequireFromString(tt.expected)) {
+				t.Errorf("Expected %s, got %s", tt.expected, result.FeeItems[0].Amount.String())
+			}
+		})
+	}
+
+	for _, rule := range []string{`$(DivCeil(1, 0), "USD")`, `$(DivFloor(1, 0), "USD")`, `$(Mod(1, 0), "USD")`} {
+		_, err := New(nil).AddRule(rule).Execute()
+		if err == nil || !strings.Contains(err.Error(), "by zero") {
+			t.Errorf("Expected zero divisor error for %s, got %v", rule, err)
+		}
+	}
+}
+
+func TestFeeEngine_AddTemplate(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 1000.0,
+		},
+	}
+	engine := New(ctx)
+
+	template := `$(amount * 0.01 + {{fixed_fee}}, "{{currency}}")`
+	err := engine.AddTemplate(template, map[string]string{
+		"fixed_fee": "2.5",
+		"currency":  "EUR",
+	})
+	if err != nil {
+		t.Fatalf("AddTemplate failed: %v", err)
+	}
+
+	if rules := engine.GetRules(); rules[0] != `$(amount * 0.01 + 2.5, "EUR")` {
+		t.Errorf("Expected expanded rule, got %s", rules[0])
+	}
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.FeeItems, "EUR"); !amount.Equal(decimal.RequireFromString("12.5")) {
+		t.Errorf("Expected EUR fee 12.5, got %s", amount.String())
+	}
+
+	if err := engine.AddTemplate(template, map[string]string{"currency": "EUR"}); err == nil {
+		t.Error("Expected error for missing template param, but got nil")
+	}
+
+	if engine.GetRuleCount() != 1 {
+		t.Errorf("Expected failed template not to be added, got %d rules", engine.GetRuleCount())
+	}
+}
+
+func TestContext_Equal(t *testing.T) {
+	build := func(amount interface{}) *Context {
+		engine := New(&Context{Vars: map[string]interface{}{"amount": amount}})
+		engine.AddRule(`$(10.5, "USD")`, `$(2.0, "EUR")`)
+		if _, err := engine.Execute(); err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		return engine.GetContext()
+	}
+
+	a := build(1000.0)
+	b := build(decimal.NewFromInt(1000))
+
+	if !a.Equal(b) {
+		t.Error("Expected equivalent contexts to compare equal")
+	}
+
+	if c := build(1001.0); a.Equal(c) {
+		t.Error("Expected contexts with different amounts to compare unequal")
+	}
+
+	fresh := &Context{Vars: map[string]interface{}{"amount": 1000.0}, FeeItems: a.FeeItems}
+	if !a.Equal(fresh) {
+		t.Error("Expected cursor to be ignored by default")
+	}
+	if a.Equal(fresh, CompareCursor()) {
+		t.Error("Expected contexts at different cursors to compare unequal with CompareCursor")
+	}
+}
+
+func TestFeeEngine_Warn(t *testing.T) {
+	newEngine := func() *FeeEngine {
+		engine := New(&Context{Vars: map[string]interface{}{"amount": 100.0}})
+		engine.AddRule(
+			`fee = amount * 0.6`,
+			`fee > amount * 0.5 ? Warn("fee exceeds 50% of amount") : nil`,
+			`$(fee, "USD")`,
+		)
+		return engine
+	}
+
+	result, err := newEngine().Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.Warnings) != 1 || result.Warnings[0] != "fee exceeds 50% of amount" {
+		t.Errorf("Expected fee warning, got %v", result.Warnings)
+	}
+
+	if result.ProcessedRules != 3 {
+		t.Errorf("Expected execution to complete all 3 rules, got %d", result.ProcessedRules)
+	}
+
+	if !findAmountByCurrency(result.FeeItems, "USD").Equal(decimal.NewFromInt(60)) {
+		t.Errorf("Expected USD fee 60, got %s", findAmountByCurrency(result.FeeItems, "USD").String())
+	}
+
+	_, err = newEngine().WithWarnAsError(true).Execute()
+	if err == nil || !strings.Contains(err.Error(), "fee exceeds 50% of amount") {
+		t.Errorf("Expected warning escalated to error, got %v", err)
+	}
+}
+
+func TestEvalRule(t *testing.T) {
+	vars := map[string]interface{}{
+		"amount": 1000.0,
+		"rate":   0.02,
+	}
+
+	result, err := EvalRule(`$(amount*rate,"USD")`, vars)
+	if err != nil {
+		t.Fatalf("EvalRule failed: %v", err)
+	}
+
+	if len(result.FeeItems) != 1 || !result.FeeItems[0].Amount.Equal(decimal.NewFromInt(20)) {
+		t.Errorf("Expected a single 20 USD fee item, got %+v", result.FeeItems)
+	}
+
+	result, err = EvalRule(`amount = amount * 2`, vars)
+	if err != nil {
+		t.Fatalf("EvalRule failed: %v", err)
+	}
+
+	if result.Context.Vars["amount"] != 2000.0 {
+		t.Errorf("Expected assignment in result context, got %v", result.Context.Vars["amount"])
+	}
+
+	if vars["amount"] != 1000.0 {
+		t.Errorf("Expected input vars to be unchanged, got %v", vars["amount"])
+	}
+
+	var compileErr *CompileError
+	if _, err := EvalRule(`$(missing, "USD")`, vars); !errors.As(err, &compileErr) {
+		t.Errorf("Expected CompileError for unknown var, got %v", err)
+	}
+}
+
+func TestFeeEngine_AddFinalRule(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(1.0, "USD")`)
+	if err := engine.AddFinalRule(`$(Net("USD"), "USD")`); err != nil {
+		t.Fatalf("AddFinalRule failed: %v", err)
+	}
+	engine.AddRule(`$(2.0, "USD")`)
+
+	rules := engine.GetRules()
+	expected := []string{`$(1.0, "USD")`, `$(2.0, "USD")`, `$(Net("USD"), "USD")`}
+	if len(rules) != len(expected) {
+		t.Fatalf("Expected %d rules, got %v", len(expected), rules)
+	}
+	for i := range expected {
+		if rules[i] != expected[i] {
+			t.Errorf("Expected rule %d to be %s, got %s", i, expected[i], rules[i])
+		}
+	}
+
+	if err := engine.AddFinalRule(`$(3.0, "USD")`); err == nil {
+		t.Error("Expected error when adding a second final rule, but got nil")
+	}
+
+	result, err := engine.SetVar("amount", 10.0).Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if !result.Halted {
+		t.Error("Expected execution to halt after the final rule")
+	}
+
+	if result.ProcessedRules != 3 {
+		t.Errorf("Expected 3 processed rules, got %d", result.ProcessedRules)
+	}
+
+	// Net sees the 3 USD charged by the earlier rules
+	if amount := result.FeeItems[2].Amount; !amount.Equal(decimal.NewFromInt(7)) {
+		t.Errorf("Expected final rule to run last with Net 7, got %s", amount.String())
+	}
+}
+
+func TestFeeEngine_WithConfig(t *testing.T) {
+	type feeConfig struct {
+		FiatFeeRate   float64 `expr:"fiat_fee_rate"`
+		WelloFeeFixed float64 `expr:"wello_fee_fixed"`
+	}
+
+	engine := New(&Context{Vars: map[string]interface{}{"amount": 1000.0}})
+	engine.WithConfig(feeConfig{FiatFeeRate: 0.01, WelloFeeFixed: 2.5})
+	engine.AddRule(
+		`$(amount * cfg.fiat_fee_rate, "USD")`,
+		`$(cfg.wello_fee_fixed, "USD")`,
+	)
+
+	for run := 0; run < 2; run++ {
+		result, err := engine.Reset().Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+
+		if total := findAmountByCurrency(result.Summary, "USD"); !total.Equal(decimal.RequireFromString("12.5")) {
+			t.Errorf("Run %d: expected USD total 12.5, got %s", run, total.String())
+		}
+	}
+
+	engine.AddRule(`cfg = 1`)
+	if _, err := engine.Reset().Execute(); err == nil {
+		t.Error("Expected error when assigning to cfg, but got nil")
+	}
+}
+
+func TestFeeEngine_NonFiniteInputs(t *testing.T) {
+	engine := New(nil).SetVar("amount", math.NaN()).SetVar("rate", 0.01)
+	engine.AddRule(`$(amount * rate, "USD")`)
+
+	_, err := engine.Execute()
+	if !errors.Is(err, ErrNonFinite) {
+		t.Fatalf("Expected ErrNonFinite for NaN amount, got %v", err)
+	}
+	if !strings.Contains(err.Error(), `var "amount"`) {
+		t.Errorf("Expected error to name the amount var, got %v", err)
+	}
+
+	engine = New(nil).SetVar("amount", 100.0).SetVar("rate", math.Inf(1))
+	engine.AddRule(`$(amount * rate, "USD")`)
+
+	_, err = engine.Execute()
+	if !errors.Is(err, ErrNonFinite) {
+		t.Fatalf("Expected ErrNonFinite for Inf rate, got %v", err)
+	}
+	if !strings.Contains(err.Error(), `var "rate"`) {
+		t.Errorf("Expected error to name the rate var, got %v", err)
+	}
+
+	engine = New(&Context{Vars: map[string]interface{}{"amount": 100.0, "zero": 0.0}})
+	engine.AddRule(`$(amount / zero, "USD")`)
+
+	if _, err = engine.Execute(); !errors.Is(err, ErrNonFinite) {
+		t.Errorf("Expected ErrNonFinite for infinite fee amount, got %v", err)
+	}
+}
+
+func TestFeeEngine_NonFiniteVarsDoNotPanic(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"nan": math.NaN(), "inf": math.Inf(1)}})
+
+	if _, ok := engine.GetVarDecimal("nan"); ok {
+		t.Error("Expected GetVarDecimal to report false for NaN")
+	}
+	if _, ok := engine.GetVarDecimal("inf"); ok {
+		t.Error("Expected GetVarDecimal to report false for Inf")
+	}
+
+	other := New(&Context{Vars: map[string]interface{}{"nan": math.NaN(), "inf": math.Inf(1)}})
+	if engine.GetContext().Equal(other.GetContext()) {
+		t.Error("Expected contexts holding NaN not to be equal")
+	}
+	delete(engine.GetContext().Vars, "nan")
+	delete(other.GetContext().Vars, "nan")
+	if !engine.GetContext().Equal(other.GetContext()) {
+		t.Error("Expected contexts holding the same infinity to be equal")
+	}
+
+	engine.GetContext().FeeItems = []FeeItem{{Amount: decimal.NewFromInt(10), Currency: "USD"}}
+	engine.DistributeDiscount(math.NaN(), "USD")
+	if amount := engine.GetContext().FeeItems[0].Amount; !amount.Equal(decimal.NewFromInt(10)) {
+		t.Errorf("Expected NaN discount to be ignored, got %s", amount.String())
+	}
+}
+
+func TestFeeEngine_TaxHelpers(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(
+		`$(TaxInclusive(120, 0.2), "USD")`,
+		`$(TaxExclusive(100, 0.2), "EUR")`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.FeeItems, "USD"); !amount.Equal(decimal.NewFromInt(20)) {
+		t.Errorf("Expected inclusive tax 20, got %s", amount.String())
+	}
+
+	if amount := findAmountByCurrency(result.FeeItems, "EUR"); !amount.Equal(decimal.NewFromInt(20)) {
+		t.Errorf("Expected exclusive tax 20, got %s", amount.String())
+	}
+
+	engine = New(nil)
+	engine.AddRule(`$(TaxInclusive(120, -1), "USD")`)
+	if _, err := engine.Execute(); err == nil {
+		t.Error("Expected error for a -100% tax rate, but got nil")
+	}
+}
+
+func TestFeeEngine_MaxFeeItems(t *testing.T) {
+	engine := New(nil).WithMaxFeeItems(5)
+	engine.AddRule(
+		`[$(1.0, "USD"), $(2.0, "USD")]`,
+		`map(1..100, {$(#, "USD")})`,
+	)
+
+	_, err := engine.Execute()
+	if !errors.Is(err, ErrMaxFeeItems) {
+		t.Fatalf("Expected ErrMaxFeeItems, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "rule at index 1") {
+		t.Errorf("Expected error to name rule index 1, got %v", err)
+	}
+
+	if count := len(engine.GetContext().FeeItems); count != 2 {
+		t.Errorf("Expected only the first rule's 2 fee items to be kept, got %d", count)
+	}
+
+	unlimited := New(nil)
+	unlimited.AddRule(`map(1..100, {$(#, "USD")})`)
+	result, err := unlimited.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(result.FeeItems) != 100 {
+		t.Errorf("Expected 100 fee items without a limit, got %d", len(result.FeeItems))
+	}
+}
+
+func TestFeeEngine_ClockHelpers(t *testing.T) {
+	run := func(now time.Time) *ExecuteResult {
+		engine := New(nil).SetVar("amount", 100.0).WithClock(func() time.Time { return now })
+		engine.AddRule(
+			`IsWeekend() ? $(amount*0.03, "USD") : $(amount*0.02, "USD")`,
+			`Hour() >= 18 ? $(1.0, "EUR") : $(0.0, "EUR")`,
+			`Set("weekday", Weekday())`,
+		)
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		return result
+	}
+
+	saturday := run(time.Date(2026, 10, 17, 20, 0, 0, 0, time.UTC))
+	if amount := findAmountByCurrency(saturday.FeeItems, "USD"); !amount.Equal(decimal.NewFromInt(3)) {
+		t.Errorf("Expected weekend fee 3, got %s", amount.String())
+	}
+	if amount := findAmountByCurrency(saturday.FeeItems, "EUR"); !amount.Equal(decimal.NewFromInt(1)) {
+		t.Errorf("Expected evening surcharge 1, got %s", amount.String())
+	}
+	if weekday := saturday.Context.Vars["weekday"]; weekday != int(time.Saturday) {
+		t.Errorf("Expected weekday %d, got %v", time.Saturday, weekday)
+	}
+
+	tuesday := run(time.Date(2026, 10, 13, 9, 0, 0, 0, time.UTC))
+	if amount := findAmountByCurrency(tuesday.FeeItems, "USD"); !amount.Equal(decimal.NewFromInt(2)) {
+		t.Errorf("Expected weekday fee 2, got %s", amount.String())
+	}
+	if amount := findAmountByCurrency(tuesday.FeeItems, "EUR"); !amount.IsZero() {
+		t.Errorf("Expected no morning surcharge, got %s", amount.String())
+	}
+}
+
+func TestFeeEngine_ResetKeepLogs(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"amount": 100.0}}).EnableLog()
+	engine.AddRule(`$(amount * 0.01, "USD")`, `amount = amount * 2`)
+
+	if _, err := engine.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	result, err := engine.ResetKeepLogs().Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.FeeItems) != 1 || !result.FeeItems[0].Amount.Equal(decimal.NewFromInt(1)) {
+		t.Errorf("Expected fee items and vars to be reset, got %+v", result.FeeItems)
+	}
+
+	expected := []string{
+		`$(amount * 0.01, "USD")`,
+		`amount = amount * 2`,
+		`# iteration 2`,
+		`$(amount * 0.01, "USD")`,
+		`amount = amount * 2`,
+	}
+	if len(result.Logs) != len(expected) {
+		t.Fatalf("Expected %d log entries, got %d", len(expected), len(result.Logs))
+	}
+	for i, rule := range expected {
+		if result.Logs[i].Rule != rule {
+			t.Errorf("Expected log %d rule %s, got %s", i, rule, result.Logs[i].Rule)
+		}
+	}
+
+	if result, _ := engine.Reset().Execute(); len(result.Logs) != 2 {
+		t.Errorf("Expected Reset to clear kept logs, got %d entries", len(result.Logs))
+	}
+}
+
+func TestFeeEngine_Validate(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"amount": 10.0}})
+	engine.AddRule(
+		`fee = amount * 0.01`,
+		`$(fee, "USD")`,
+		`amount > 5`,
+		`amount > 5 ? $(1.0, "USD") : nil`,
+		`[$(1.0, "EUR")]`,
+	)
+
+	err := engine.Validate()
+	if err == nil {
+		t.Fatal("Expected Validate to flag the bool rule, but got nil")
+	}
+
+	var compileErr *CompileError
+	if !errors.As(err, &compileErr) || compileErr.Index != 2 {
+		t.Fatalf("Expected CompileError at index 2, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "bool") {
+		t.Errorf("Expected error to mention the bool result, got %v", err)
+	}
+
+	if count := len(engine.GetContext().FeeItems); count != 0 {
+		t.Errorf("Expected Validate not to touch the engine, got %d fee items", count)
+	}
+
+	if _, err := engine.Execute(); err != nil {
+		t.Errorf("Expected Execute to still run the rules, got %v", err)
+	}
+
+	valid := New(nil).SetVar("amount", 10.0)
+	valid.AddRule(`$(amount * 0.01, "USD")`, `# note`, `Set("x", 1)`)
+	if err := valid.Validate(); err != nil {
+		t.Errorf("Expected valid rules to pass, got %v", err)
+	}
+}
+
+func TestFeeEngine_Repeat(t *testing.T) {
+	engine := New(nil).SetVar("amount", 100.0)
+	engine.AddRule(
+		`Repeat(5, "amount = amount * 1.01")`,
+		`Repeat(3, "$(0.5, 'USD')")`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	amount, _ := engine.GetVar("amount")
+	want := 100 * 1.01 * 1.01 * 1.01 * 1.01 * 1.01
+	if math.Abs(amount.(float64)-want) > 1e-9 {
+		t.Errorf("Expected compounded amount %v, got %v", want, amount)
+	}
+
+	if len(result.FeeItems) != 3 {
+		t.Fatalf("Expected 3 repeated fee items, got %d", len(result.FeeItems))
+	}
+
+	if total := findAmountByCurrency(result.Summary, "USD"); !total.Equal(decimal.RequireFromString("1.5")) {
+		t.Errorf("Expected USD total 1.5, got %s", total.String())
+	}
+}
+
+func TestFeeEngine_ComparisonIsNotAssignment(t *testing.T) {
+	engine := New(nil).SetVar("tier", 2).SetVar("amount", 100.0)
+	engine.AddRule(`tier == 2 ? $(amount * 0.01, "USD") : nil`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if total := findAmountByCurrency(result.Summary, "USD"); !total.Equal(decimal.NewFromInt(1)) {
+		t.Errorf("Expected USD total 1, got %s", total.String())
+	}
+}
+
+func TestFeeEngine_EarlyReturn(t *testing.T) {
+	rule := `fee = amount * 0.01; fee > 5 ? return $(fee, "USD") : nil; $(1.0, "EUR")`
+
+	result, err := New(nil).SetVar("amount", 1000.0).AddRule(rule).Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.FeeItems) != 1 || result.FeeItems[0].Currency != "USD" {
+		t.Fatalf("Expected early return to produce only the USD fee, got %+v", result.FeeItems)
+	}
+	if !result.FeeItems[0].Amount.Equal(decimal.NewFromInt(10)) {
+		t.Errorf("Expected USD fee 10, got %s", result.FeeItems[0].Amount.String())
+	}
+
+	result, err = New(nil).SetVar("amount", 100.0).AddRule(rule).Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.FeeItems) != 1 || result.FeeItems[0].Currency != "EUR" {
+		t.Errorf("Expected the trailing EUR fee without an early return, got %+v", result.FeeItems)
+	}
+
+	if got := rewriteReturn(`x > 1 ? return $(1, "USD: return") : (return nil)`); got != `x > 1 ? Return($(1, "USD: return")) : (Return(nil))` {
+		t.Errorf("Unexpected rewrite: %s", got)
+	}
+}
+
+func TestFeeEngine_BpsOf(t *testing.T) {
+	engine := New(nil).SetVar("amount", 1000.0).SetVar("notional", 50000.0)
+	engine.AddRule(`$(BpsOf(notional, 25), "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	// 25bps of the 50000 notional, not of the 1000 amount
+	if amount := findAmountByCurrency(result.FeeItems, "USD"); !amount.Equal(decimal.NewFromInt(125)) {
+		t.Errorf("Expected fee 125, got %s", amount.String())
+	}
+}
+
+func TestFeeEngine_StrictNoOp(t *testing.T) {
+	newEngine := func() *FeeEngine {
+		engine := New(nil).SetVar("amount", 1000.0).SetVar("rate", 0.01)
+		engine.AddRule(`fee = amount * rate`, `$(fee, "USD")`, `amount * rate`)
+		return engine
+	}
+
+	result, err := newEngine().Execute()
+	if err != nil {
+		t.Fatalf("Expected the no-op rule to be ignored by default, got %v", err)
+	}
+	if len(result.FeeItems) != 1 {
+		t.Errorf("Expected 1 fee item, got %d", len(result.FeeItems))
+	}
+
+	_, err = newEngine().WithStrictNoOp(true).Execute()
+	var runtimeErr *RuntimeError
+	if !errors.As(err, &runtimeErr) {
+		t.Fatalf("Expected RuntimeError in strict mode, got %v", err)
+	}
+	if runtimeErr.Index != 2 || runtimeErr.Rule != `amount * rate` {
+		t.Errorf("Expected error to name rule 2, got index %d rule %q", runtimeErr.Index, runtimeErr.Rule)
+	}
+}
+
+func TestFeeEngine_Accumulate(t *testing.T) {
+	engine := New(nil).SetVar("fiat_fee", 1.5).SetVar("wello_fee", 2.25)
+	engine.AddRule(
+		`Accumulate("total_fee", fiat_fee)`,
+		`Accumulate("total_fee", wello_fee)`,
+		`Accumulate("total_fee", 0.25) > 3 ? $(total_fee, "USD") : nil`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	total, _ := engine.GetVar("total_fee")
+	if total != 4.0 {
+		t.Errorf("Expected total_fee 4, got %v", total)
+	}
+
+	if amount := findAmountByCurrency(result.FeeItems, "USD"); !amount.Equal(decimal.NewFromInt(4)) {
+		t.Errorf("Expected USD fee 4, got %s", amount.String())
+	}
+
+	engine = New(nil).SetVarDecimal("total_fee", decimal.RequireFromString("0.1"))
+	engine.AddRule(`Accumulate("total_fee", 0.2)`)
+	if _, err := engine.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	total, _ = engine.GetVar("total_fee")
+	if d, ok := total.(decimal.Decimal); !ok || !d.Equal(decimal.RequireFromString("0.3")) {
+		t.Errorf("Expected decimal total 0.3, got %v (%T)", total, total)
+	}
+}
+
+func TestFeeEngine_DefineMacro(t *testing.T) {
+	engine := New(nil).SetVar("amount", 1000.0)
+	engine.DefineMacro("pctFee", []string{"amt", "r"}, "amt * r + 50")
+	engine.DefineMacro("usdFee", []string{"r"}, `$(pctFee(amount, r), "USD")`)
+	engine.AddRule(
+		`$(pctFee(amount, 0.01), "USD")`,
+		`fee = pctFee(200, 0.5); $(fee, "EUR")`,
+		`usdFee(0.02)`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(130)) {
+		t.Errorf("Expected USD total 130, got %s", amount.String())
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "EUR"); !amount.Equal(decimal.NewFromInt(150)) {
+		t.Errorf("Expected EUR total 150, got %s", amount.String())
+	}
+
+	engine.AddRule(`pctFee(1)`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "takes 2 arguments") {
+		t.Errorf("Expected arity error, got %v", err)
+	}
+}
+
+func TestFeeEngine_DefineMacroRecursion(t *testing.T) {
+	engine := New(nil)
+	engine.DefineMacro("f", []string{"x"}, "f(x)")
+	engine.AddRule(`$(f(1), "USD")`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "nested too deep") {
+		t.Errorf("Expected depth error for a self-referencing macro, got %v", err)
+	}
+
+	engine = New(nil).WithMaxExprDepth(4)
+	engine.DefineMacro("ping", []string{"x"}, "pong(x)")
+	engine.DefineMacro("pong", []string{"x"}, "ping(x)")
+	engine.AddRule(`$(ping(1), "USD")`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "nested too deep") {
+		t.Errorf("Expected depth error for mutually recursive macros, got %v", err)
+	}
+
+	// Recursion that ends within the limit is allowed
+	engine = New(nil)
+	engine.DefineMacro("steps", []string{"n"}, "n <= 0 ? 0 : steps(n - 1) + 1")
+	engine.AddRule(`$(steps(5), "USD")`)
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(5)) {
+		t.Errorf("Expected USD total 5, got %s", amount.String())
+	}
+}
+
+func TestFeeEngine_ExecuteStream(t *testing.T) {
+	engine := New(nil).SetVar("amount", 100.0)
+	engine.AddRule(
+		`Repeat(1000, "$(amount * 0.01, \"USD\")")`,
+		`$(5, "EUR")`,
+	)
+
+	count := 0
+	total := decimal.Zero
+	err := engine.ExecuteStream(func(item FeeItem) error {
+		count++
+		total = total.Add(item.Amount)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ExecuteStream failed: %v", err)
+	}
+
+	if count != 1001 {
+		t.Errorf("Expected 1001 streamed fee items, got %d", count)
+	}
+
+	if !total.Equal(decimal.NewFromInt(1005)) {
+		t.Errorf("Expected streamed total 1005, got %s", total.String())
+	}
+
+	if items := engine.GetContext().FeeItems; len(items) != 0 {
+		t.Errorf("Expected no fee items retained on the context, got %d", len(items))
+	}
+
+	// Callback errors abort execution
+	engine.Reset()
+	engine.SetVar("amount", 100.0)
+	stop := errors.New("sink full")
+	count = 0
+	err = engine.ExecuteStream(func(item FeeItem) error {
+		count++
+		if count == 10 {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Fatalf("Expected sink error, got %v", err)
+	}
+
+	if count != 10 {
+		t.Errorf("Expected delivery to stop after 10 items, got %d", count)
+	}
+
+	// The engine goes back to collecting fee items afterwards
+	engine.Reset()
+	engine.SetVar("amount", 100.0)
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if len(result.FeeItems) != 1001 {
+		t.Errorf("Expected 1001 fee items, got %d", len(result.FeeItems))
+	}
+}
+
+func TestFeeEngine_TierCapped(t *testing.T) {
+	brackets := `[[0, 0.01, 5], [1000, 0.005, 30], [10000, 0.002, 50]]`
+	cases := []struct {
+		amount   float64
+		expected string
+	}{
+		{200, "2"},     // 200 * 1%
+		{800, "5"},     // 800 * 1% capped at 5
+		{3000, "15"},   // 5 + 2000 * 0.5%
+		{20000, "55"},  // 5 + 30 (capped from 45) + 20
+		{100000, "85"}, // 5 + 30 + 50 (capped from 180)
+	}
+
+	for _, c := range cases {
+		engine := New(nil).SetVar("amount", c.amount)
+		engine.AddRule(`$(TierCapped(amount, ` + brackets + `), "USD")`)
+
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed for amount %v: %v", c.amount, err)
+		}
+
+		if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.RequireFromString(c.expected)) {
+			t.Errorf("Amount %v: expected fee %s, got %s", c.amount, c.expected, amount.String())
+		}
+	}
+
+	engine := New(nil).SetVar("amount", 100.0)
+	engine.AddRule(`$(TierCapped(amount, [[1000, 0.01], [0, 0.02]]), "USD")`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "ascending") {
+		t.Errorf("Expected ascending threshold error, got %v", err)
+	}
+}
+
+func TestFeeEngine_FeeItems(t *testing.T) {
+	surcharge := `any(FeeItems(), .amount > 100) ? $(25, "USD") : nil`
+	cases := []struct {
+		amount   float64
+		expected int64
+	}{
+		{5000, 175}, // 150 fee exceeds 100, surcharge applies
+		{2000, 60},  // 60 fee, no surcharge
+	}
+
+	for _, c := range cases {
+		engine := New(nil).SetVar("amount", c.amount)
+		engine.AddRule(`$(amount * 0.03, "USD")`, surcharge)
+
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+
+		if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(c.expected)) {
+			t.Errorf("Amount %v: expected total %d, got %s", c.amount, c.expected, amount.String())
+		}
+	}
+
+	// Fields are readable and the snapshot excludes the rule's own fee items
+	engine := New(nil)
+	engine.AddRule(
+		`$(10, "eur")`,
+		`items = FeeItems(); $(float(len(items)), items[0].currency)`,
+		`$(len(FeeItems()), "USD")`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "EUR"); !amount.Equal(decimal.NewFromInt(11)) {
+		t.Errorf("Expected EUR total 11, got %s", amount.String())
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(2)) {
+		t.Errorf("Expected USD total 2, got %s", amount.String())
+	}
+}
+
+func TestFeeEngine_LargeUnsignedAmount(t *testing.T) {
+	engine := New(nil).SetVar("amount", uint64(math.MaxUint64))
+	engine.AddRule(`$(amount, "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	expected := decimal.RequireFromString("18446744073709551615")
+	if !result.FeeItems[0].Amount.Equal(expected) {
+		t.Errorf("Expected fee %s, got %s", expected.String(), result.FeeItems[0].Amount.String())
+	}
+}
+
+func TestFeeEngine_ConditionalCurrency(t *testing.T) {
+	for _, crypto := range []bool{true, false} {
+		engine := New(nil).
+			SetVar("fee", 12.5).
+			SetVar("payout_is_crypto", crypto).
+			SetVar("crypto_currency", "usdt").
+			SetVar("fiat_currency", Currency("USD"))
+		engine.AddRule(
+			`$(fee, payout_is_crypto ? crypto_currency : fiat_currency)`,
+			`$(1, payout_is_crypto ? "BTC" : "EUR")`,
+		)
+
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+
+		expected := []Currency{"USD", "EUR"}
+		if crypto {
+			expected = []Currency{"USDT", "BTC"}
+		}
+		for i, item := range result.FeeItems {
+			if item.Currency != expected[i] {
+				t.Errorf("crypto=%v: expected fee item %d in %s, got %s", crypto, i, expected[i], item.Currency)
+			}
+		}
+	}
+
+	engine := New(nil).SetVar("currency", 840)
+	engine.AddRule(`$(1, currency)`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "currency must be a string") {
+		t.Errorf("Expected currency type error, got %v", err)
+	}
+}
+
+func TestFeeEngine_Prorate(t *testing.T) {
+	cases := []struct {
+		fraction float64
+		clamp    bool
+		expected string
+	}{
+		{0.5, true, "50"},
+		{1.3, true, "100"},
+		{-0.2, true, "0"},
+		{1.3, false, "130"},
+	}
+
+	for _, c := range cases {
+		engine := New(nil).WithProrateClamp(c.clamp).SetVar("used", c.fraction)
+		engine.AddRule(`$(Prorate(100, used), "USD")`)
+
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+
+		if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.RequireFromString(c.expected)) {
+			t.Errorf("Fraction %v (clamp %v): expected %s, got %s", c.fraction, c.clamp, c.expected, amount.String())
+		}
+	}
+}
+
+func TestFeeEngine_WithSummaryMultiplier(t *testing.T) {
+	engine := New(nil).WithSummaryMultiplier(decimal.RequireFromString("0.9"))
+	engine.AddRule(`$(60, "USD")`, `$(40, "USD")`, `$(-10.01, "EUR")`)
+	engine.WithRounding(2)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(90)) {
+		t.Errorf("Expected USD summary 90, got %s", amount.String())
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "EUR"); !amount.Equal(decimal.RequireFromString("-9.01")) {
+		t.Errorf("Expected EUR summary -9.01, got %s", amount.String())
+	}
+
+	if !result.FeeItems[0].Amount.Equal(decimal.NewFromInt(60)) {
+		t.Errorf("Expected raw fee item to stay 60, got %s", result.FeeItems[0].Amount.String())
+	}
+}
+
+func TestFeeEngine_WithDecimalContext(t *testing.T) {
+	coarse := New(nil).WithDecimalContext(2, RoundDown)
+	coarse.AddRule(`$(Div(1, 3), "USD")`, `$(Round(2.678, 1), "EUR")`, `$(Quantize(1.24, 0.05), "GBP")`)
+	fine := New(nil).WithDecimalContext(6, RoundHalfEven)
+	fine.AddRule(`$(Div(1, 3), "USD")`, `$(Round(2.65, 1), "EUR")`, `$(Quantize(1.225, 0.05), "GBP")`)
+
+	var wg sync.WaitGroup
+	results := make([]*ExecuteResult, 2)
+	errs := make([]error, 2)
+	for i, engine := range []*FeeEngine{coarse, fine} {
+		wg.Add(1)
+		go func(i int, engine *FeeEngine) {
+			defer wg.Done()
+			for n := 0; n < 100; n++ {
+				engine.Reset()
+				results[i], errs[i] = engine.Execute()
+			}
+		}(i, engine)
+	}
+	wg.Wait()
+
+	expected := [][]string{
+		{"0.33", "2.6", "1.2"},
+		{"0.333333", "2.6", "1.2"},
+	}
+	for i, result := range results {
+		if errs[i] != nil {
+			t.Fatalf("Execute failed: %v", errs[i])
+		}
+		for j, item := range result.FeeItems {
+			if item.Amount.String() != expected[i][j] {
+				t.Errorf("Engine %d, item %d: expected %s, got %s", i, j, expected[i][j], item.Amount.String())
+			}
+		}
+	}
+}
+
+func TestFeeEngine_ExecuteTagged(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"amount": 1000.0}})
+	engine.AddRule(`$(amount * 0.01, "USD")`)
+	engine.AddTaggedRule([]string{"tax"}, `vat = amount * 0.2; $(vat, "USD")`)
+	engine.AddTaggedRule([]string{"promo"}, `$(-5, "USD")`)
+	engine.AddTaggedRule([]string{"levy", "tax"}, `$(vat * 0.1, "USD")`)
+
+	result, err := engine.ExecuteTagged("tax")
+	if err != nil {
+		t.Fatalf("ExecuteTagged failed: %v", err)
+	}
+
+	if result.ProcessedRules != 2 {
+		t.Errorf("Expected 2 processed rules, got %d", result.ProcessedRules)
+	}
+
+	if len(result.FeeItems) != 2 {
+		t.Fatalf("Expected 2 fee items, got %d", len(result.FeeItems))
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(220)) {
+		t.Errorf("Expected USD total 220, got %s", amount.String())
+	}
+
+	result, err = engine.ExecuteTagged("missing")
+	if err != nil {
+		t.Fatalf("ExecuteTagged failed: %v", err)
+	}
+
+	if result.ProcessedRules != 0 || len(result.FeeItems) != 0 {
+		t.Errorf("Expected no rules run for an unknown tag, got %d rules and %d fee items", result.ProcessedRules, len(result.FeeItems))
+	}
+}
+
+func TestFeeEngine_WithDropZeroFees(t *testing.T) {
+	for _, drop := range []bool{true, false} {
+		engine := New(nil).EnableLog().WithDropZeroFees(drop)
+		engine.AddRule(`$(0, "USD")`, `$(1.5, "USD")`)
+
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+
+		expected := 2
+		if drop {
+			expected = 1
+		}
+		if len(result.FeeItems) != expected {
+			t.Errorf("drop=%v: expected %d fee items, got %d", drop, expected, len(result.FeeItems))
+		}
+
+		if len(result.Logs[0].FeeItems) != 1 {
+			t.Errorf("drop=%v: expected the zero fee item in the log, got %v", drop, result.Logs[0].FeeItems)
+		}
+	}
+}
+
+func TestFeeEngine_Prev(t *testing.T) {
+	engine := New(nil).SetVar("amount", 100.0).SetVar("rate", 0.1)
+	engine.AddRule(
+		`amount = amount * 2`,
+		`$(Mul(Prev("amount"), rate), "USD")`,
+		`$(Mul(amount, rate), "EUR")`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(10)) {
+		t.Errorf("Expected USD fee on the original amount 10, got %s", amount.String())
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "EUR"); !amount.Equal(decimal.NewFromInt(20)) {
+		t.Errorf("Expected EUR fee on the doubled amount 20, got %s", amount.String())
+	}
+
+	engine = New(nil)
+	engine.AddRule(`x = 1`, `$(Prev("x"), "USD")`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "was not set") {
+		t.Errorf("Expected unset var error, got %v", err)
+	}
+}
+
+func TestFeeEngine_ExecuteWith(t *testing.T) {
+	engine := New(nil).
+		SetVar("amount", 10.0).
+		WithConstants(map[string]interface{}{"flat": 50}).
+		WithRates(Rate{Base: "USD", Quote: "KES", Mid: decimal.NewFromInt(130)})
+	engine.AddRule(`$(Add(Convert(amount, "USD", "KES"), flat), "KES")`)
+
+	base, err := engine.ExecuteWith(Overrides{})
+	if err != nil {
+		t.Fatalf("ExecuteWith failed: %v", err)
+	}
+
+	whatIf, err := engine.ExecuteWith(Overrides{
+		Vars:      map[string]interface{}{"amount": 20.0},
+		Constants: map[string]interface{}{"flat": 0},
+		Rates:     []Rate{{Base: "USD", Quote: "KES", Mid: decimal.NewFromInt(140)}},
+	})
+	if err != nil {
+		t.Fatalf("ExecuteWith failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(base.Summary, "KES"); !amount.Equal(decimal.NewFromInt(1350)) {
+		t.Errorf("Expected default summary 1350 KES, got %s", amount.String())
+	}
+
+	if amount := findAmountByCurrency(whatIf.Summary, "KES"); !amount.Equal(decimal.NewFromInt(2800)) {
+		t.Errorf("Expected overridden summary 2800 KES, got %s", amount.String())
+	}
+
+	// The engine itself is untouched and still runs with its own values
+	if len(engine.GetContext().FeeItems) != 0 || engine.GetContext().lastExecutedRule != 0 {
+		t.Errorf("Expected engine state unchanged after ExecuteWith")
+	}
+
+	if amount, _ := engine.GetVar("amount"); amount != 10.0 {
+		t.Errorf("Expected amount var to stay 10, got %v", amount)
+	}
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "KES"); !amount.Equal(decimal.NewFromInt(1350)) {
+		t.Errorf("Expected engine summary 1350 KES, got %s", amount.String())
+	}
+}
+
+func TestFeeEngine_LogDecimalVars(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": decimal.RequireFromString("10000.50"),
+			"rate":   float32(0.25),
+		},
+	}
+	engine := New(ctx).EnableLog()
+	engine.AddRule(`fee = Mul(amount, 0.01)`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	defer func(old bool) { decimal.MarshalJSONWithoutQuotes = old }(decimal.MarshalJSONWithoutQuotes)
+	var outputs []string
+	for _, withoutQuotes := range []bool{false, true} {
+		decimal.MarshalJSONWithoutQuotes = withoutQuotes
+		data, err := json.Marshal(result.Logs[0])
+		if err != nil {
+			t.Fatalf("Marshal failed: %v", err)
+		}
+		outputs = append(outputs, string(data))
+	}
+
+	expected := `"vars":{"amount":"10000.5","fee":"100.005","rate":0.25}`
+	for _, output := range outputs {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected log vars %s, got %s", expected, output)
+		}
+	}
+
+	if _, ok := result.Logs[0].Vars["amount"].(decimal.Decimal); !ok {
+		t.Errorf("Expected decimal var kept as decimal in the log, got %T", result.Logs[0].Vars["amount"])
+	}
+
+	if _, ok := result.Logs[0].Vars["rate"].(float32); !ok {
+		t.Errorf("Expected float32 var kept as float32, got %T", result.Logs[0].Vars["rate"])
+	}
+}
+
+func TestFeeEngine_GrossUp(t *testing.T) {
+	engine := New(nil).SetVar("net", 970.0)
+	engine.AddRule(`gross = GrossUp(net, 0.03); $(Sub(gross, net), "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	gross, _ := engine.GetVar("gross")
+	if !toDecimal(gross).Equal(decimal.NewFromInt(1000)) {
+		t.Errorf("Expected gross 1000, got %v", gross)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(30)) {
+		t.Errorf("Expected fee 30, got %s", amount.String())
+	}
+
+	engine = New(nil)
+	engine.AddRule(`$(GrossUp(100, 1), "USD")`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "must be below 1") {
+		t.Errorf("Expected rate error, got %v", err)
+	}
+}
+
+func TestFeeEngine_Stop(t *testing.T) {
+	engine := New(nil)
+	capped := `Gt(Fees("USD"), 500) ? Stop() : $(200, "USD")`
+	engine.AddRule(capped, capped, capped, capped, capped)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if !result.Halted {
+		t.Errorf("Expected execution to be halted")
+	}
+
+	// The fourth rule sees 600 USD from the first three and stops
+	if result.ProcessedRules != 4 {
+		t.Errorf("Expected 4 processed rules, got %d", result.ProcessedRules)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(600)) {
+		t.Errorf("Expected USD total 600, got %s", amount.String())
+	}
+
+	// Resuming does not run further rules; Reset clears the halt
+	result, err = engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if result.ProcessedRules != 0 {
+		t.Errorf("Expected no rules after a stop, got %d", result.ProcessedRules)
+	}
+
+	engine.Reset()
+	if result, err = engine.ExecuteN(2); err != nil || result.Halted {
+		t.Errorf("Expected Reset to clear the halt, got halted=%v err=%v", result != nil && result.Halted, err)
+	}
+}
+
+func TestFeeEngine_WithTxID(t *testing.T) {
+	engine := New(nil).EnableLog().WithTxID("tx-42")
+	engine.AddRule(`fee = 5`, `$(fee, "USD")`, `# done`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if result.TxID != "tx-42" || result.Context.TxID != "tx-42" {
+		t.Errorf("Expected TxID tx-42 on the result and context, got %q and %q", result.TxID, result.Context.TxID)
+	}
+
+	if len(result.Logs) != 3 {
+		t.Fatalf("Expected 3 log entries, got %d", len(result.Logs))
+	}
+	for i, entry := range result.Logs {
+		if entry.TxID != "tx-42" {
+			t.Errorf("Expected TxID tx-42 on log %d, got %q", i, entry.TxID)
+		}
+	}
+
+	msg, err := result.ToProto()
+	if err != nil {
+		t.Fatalf("ToProto failed: %v", err)
+	}
+	decoded, err := FromProto(msg)
+	if err != nil {
+		t.Fatalf("FromProto failed: %v", err)
+	}
+
+	if decoded.TxID != "tx-42" || decoded.Logs[0].TxID != "tx-42" {
+		t.Errorf("Expected TxID to survive the proto round trip, got %q and %q", decoded.TxID, decoded.Logs[0].TxID)
+	}
+
+	engine.Reset()
+	if result, _ := engine.Execute(); result.TxID != "tx-42" {
+		t.Errorf("Expected TxID to survive Reset, got %q", result.TxID)
+	}
+}
+
+func TestFeeEngine_Preview(t *testing.T) {
+	engine := New(nil).SetVar("amount", 100.0)
+	engine.AddRule(`amount = amount * 2`, `$(amount * 0.1, "USD")`, `$(1, "EUR")`)
+
+	if _, err := engine.ExecuteN(1); err != nil {
+		t.Fatalf("ExecuteN failed: %v", err)
+	}
+
+	preview, err := engine.Preview()
+	if err != nil {
+		t.Fatalf("Preview failed: %v", err)
+	}
+
+	if preview.ProcessedRules != 2 {
+		t.Errorf("Expected the preview to run the 2 remaining rules, got %d", preview.ProcessedRules)
+	}
+
+	if amount := findAmountByCurrency(preview.Summary, "USD"); !amount.Equal(decimal.NewFromInt(20)) {
+		t.Errorf("Expected preview USD total 20, got %s", amount.String())
+	}
+
+	if cursor := engine.GetContext().lastExecutedRule; cursor != 1 {
+		t.Errorf("Expected cursor to stay at 1, got %d", cursor)
+	}
+
+	if amount, _ := engine.GetVar("amount"); amount != 200.0 {
+		t.Errorf("Expected amount to stay 200, got %v", amount)
+	}
+
+	if items := engine.GetContext().FeeItems; len(items) != 0 {
+		t.Errorf("Expected no fee items on the engine, got %d", len(items))
+	}
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if !SummaryEqual(result.Summary, preview.Summary, decimal.Zero) {
+		t.Errorf("Expected Execute to match the preview, got %v and %v", result.Summary, preview.Summary)
+	}
+}
+
+func TestFeeEngine_PreviewSkipsLogWriter(t *testing.T) {
+	var buf bytes.Buffer
+	engine := New(nil).SetVar("amount", 100.0).WithLogWriter(&buf)
+	engine.AddRule(`$(amount * 0.1, "USD")`)
+
+	if _, err := engine.Preview(); err != nil {
+		t.Fatalf("Preview failed: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("Expected the preview not to write logs, got %q", buf.String())
+	}
+
+	if _, err := engine.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if buf.Len() == 0 {
+		t.Error("Expected Execute to write logs")
+	}
+}
+
+func TestFeeEngine_AddRulesFromReader(t *testing.T) {
+	rules := "# platform fees\n$(amount * 0.01, \"USD\")\n\n  $(2.5, \"USD\")  \n"
+	engine := New(nil).SetVar("amount", 1000.0)
+
+	added, err := engine.AddRulesFromReader(strings.NewReader(rules))
+	if err != nil {
+		t.Fatalf("AddRulesFromReader failed: %v", err)
+	}
+
+	if added != 2 || engine.GetRuleCount() != 2 {
+		t.Fatalf("Expected 2 rules added, got %d (%d on the engine)", added, engine.GetRuleCount())
+	}
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.RequireFromString("12.5")) {
+		t.Errorf("Expected USD total 12.5, got %s", amount.String())
+	}
+}
+
+func TestFeeEngine_AddRuleIf(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		engine := New(nil).
+			SetVar("amount", 1000.0).
+			WithConstants(map[string]interface{}{"feature_enabled": enabled})
+		engine.AddRule(`$(amount * 0.01, "USD")`)
+		engine.AddRuleIf(`feature_enabled`, `$(-5, "USD")`)
+		engine.AddRuleIf(`!feature_enabled`, `$(1, "USD")`)
+
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+
+		expected := decimal.NewFromInt(11)
+		if enabled {
+			expected = decimal.NewFromInt(5)
+		}
+		if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(expected) {
+			t.Errorf("enabled=%v: expected USD total %s, got %s", enabled, expected.String(), amount.String())
+		}
+
+		if result.ProcessedRules != 2 {
+			t.Errorf("enabled=%v: expected 2 processed rules, got %d", enabled, result.ProcessedRules)
+		}
+	}
+
+	// Conditions only see constants
+	engine := New(nil).SetVar("vip", true)
+	engine.AddRuleIf(`vip`, `$(1, "USD")`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "enable condition") {
+		t.Errorf("Expected enable condition error for a var, got %v", err)
+	}
+
+	// Validate skips disabled rules too
+	engine = New(nil).WithConstants(map[string]interface{}{"legacy": false})
+	engine.AddRuleIf(`legacy`, `$(missing_var, "USD")`)
+	if err := engine.Validate(); err != nil {
+		t.Errorf("Expected Validate to skip the disabled rule, got %v", err)
+	}
+}
+
+func TestFeeEngine_ArrayHelpers(t *testing.T) {
+	engine := New(nil).
+		SetVar("legs", []interface{}{100, 250.5, decimal.RequireFromString("49.5")}).
+		SetVar("fx_legs", []float64{10, 20}).
+		SetVar("rate", 0.01)
+	engine.AddRule(
+		`$(Mul(Sum(legs), rate), "USD")`,
+		`map(MapMul(legs, rate), $(#, "EUR"))`,
+		`$(Product(fx_legs), "GBP")`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(4)) {
+		t.Errorf("Expected USD total 4, got %s", amount.String())
+	}
+
+	var eur []string
+	for _, item := range result.FeeItems {
+		if item.Currency == "EUR" {
+			eur = append(eur, item.Amount.String())
+		}
+	}
+	if strings.Join(eur, ",") != "1,2.505,0.495" {
+		t.Errorf("Expected per-leg EUR fees 1,2.505,0.495, got %v", eur)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "GBP"); !amount.Equal(decimal.NewFromInt(200)) {
+		t.Errorf("Expected GBP total 200, got %s", amount.String())
+	}
+
+	engine = New(nil).SetVar("legs", []interface{}{1, "x"})
+	engine.AddRule(`$(Sum(legs), "USD")`)
+	if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "not a number") {
+		t.Errorf("Expected non-numeric element error, got %v", err)
+	}
+}
+
+func TestFeeEngine_WithMaxExprDepth(t *testing.T) {
+	// An expression array evaluating to another expression array
+	engine := New(nil).SetVar("inner", `["$(1, \"USD\")", "$(2, \"USD\")"]`)
+	engine.AddRule(`[inner, "$(3, \"USD\")"]`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(6)) {
+		t.Errorf("Expected USD total 6, got %s", amount.String())
+	}
+
+	// A var that evaluates to itself recurses until the limit trips
+	for _, depth := range []int{0, 3} {
+		engine = New(nil).WithMaxExprDepth(depth).SetVar("next", "[next]")
+		engine.AddRule(`[next]`)
+		if _, err := engine.Execute(); err == nil || !strings.Contains(err.Error(), "nested too deep") {
+			t.Errorf("depth %d: expected depth error, got %v", depth, err)
+		}
+	}
+
+	engine = New(nil).WithMaxExprDepth(1).SetVar("inner", `["$(1, \"USD\")"]`)
+	engine.AddRule(`[inner]`)
+	if _, err := engine.Execute(); err == nil {
+		t.Errorf("Expected a single level of nesting to exceed depth 1")
+	}
+}
+
+func TestFeeEngine_IsComplete(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(1, "USD")`, `$(2, "USD")`, `$(3, "USD")`)
+
+	for step := 0; step < 3; step++ {
+		if engine.IsComplete() {
+			t.Fatalf("Expected engine incomplete before step %d", step)
+		}
+		if remaining := engine.RemainingRules(); remaining != 3-step {
+			t.Errorf("Expected %d remaining rules before step %d, got %d", 3-step, step, remaining)
+		}
+		if _, err := engine.ExecuteN(1); err != nil {
+			t.Fatalf("ExecuteN failed: %v", err)
+		}
+	}
+
+	if !engine.IsComplete() || engine.RemainingRules() != 0 {
+		t.Errorf("Expected engine complete after the last rule, remaining %d", engine.RemainingRules())
+	}
+
+	engine.Reset()
+	if engine.IsComplete() {
+		t.Errorf("Expected Reset to make the engine incomplete")
+	}
+
+	// A stop completes execution early
+	engine.AddRule(`Stop()`)
+	engine.AddRule(`$(4, "USD")`)
+	if _, err := engine.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if !engine.IsComplete() {
+		t.Errorf("Expected engine complete after Stop, remaining %d", engine.RemainingRules())
+	}
+}
+
+func TestFeeEngine_WithGuardDoubleExecute(t *testing.T) {
+	engine := New(nil).WithGuardDoubleExecute(true)
+	engine.AddRule(`$(10, "USD")`, `$(5, "USD")`)
+
+	if _, err := engine.Execute(); err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if _, err := engine.Execute(); !errors.Is(err, ErrAlreadyExecuted) {
+		t.Errorf("Expected ErrAlreadyExecuted on the second Execute, got %v", err)
+	}
+
+	engine.Reset()
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute after Reset failed: %v", err)
+	}
+
+	if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.NewFromInt(15)) {
+		t.Errorf("Expected USD total 15, got %s", amount.String())
+	}
+
+	// Resuming after ExecuteN is not a double execution
+	engine.Reset()
+	if _, err := engine.ExecuteN(1); err != nil {
+		t.Fatalf("ExecuteN failed: %v", err)
+	}
+	if _, err := engine.Execute(); err != nil {
+		t.Errorf("Expected Execute to resume after ExecuteN, got %v", err)
+	}
+}
+
+func TestFeeEngine_PctOrFixed(t *testing.T) {
+	cases := []struct {
+		amount   float64
+		expected string
+	}{
+		{100, "5"},     // 1 < 5, fixed floor wins
+		{500, "5"},     // equal
+		{20000, "200"}, // percentage wins
+	}
+
+	for _, c := range cases {
+		engine := New(nil).SetVar("amount", c.amount)
+		engine.AddRule(`$(PctOrFixed(amount, 0.01, 5), "USD")`)
+
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+
+		if amount := findAmountByCurrency(result.Summary, "USD"); !amount.Equal(decimal.RequireFromString(c.expected)) {
+			t.Errorf("Amount %v: expected fee %s, got %s", c.amount, c.expected, amount.String())
+		}
+	}
+}
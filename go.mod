@@ -5,4 +5,5 @@ go 1.25.0
 require (
 	github.com/expr-lang/expr v1.17.6
 	github.com/shopspring/decimal v1.4.0
+	google.golang.org/protobuf v1.36.6
 )
@@ -0,0 +1,75 @@
+package feecalc
+
+import (
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// Pipeline runs fee engines in sequence, handing each stage's summary totals
+// to the next stage as vars, e.g. network fees feeding platform fees
+type Pipeline struct {
+	stages []pipelineStage
+}
+
+type pipelineStage struct {
+	engine *FeeEngine
+	// mapping maps a currency of the previous stage's summary to a var name
+	mapping map[string]string
+}
+
+// PipelineResult holds the result of every stage and the fee items of all
+// stages combined
+type PipelineResult struct {
+	Stages   []*ExecuteResult `json:"stages"`
+	FeeItems []FeeItem        `json:"fee_items"`
+	Summary  []FeeItem        `json:"summary"`
+}
+
+// NewPipeline starts a pipeline with the given engine as its first stage
+func NewPipeline(first *FeeEngine) *Pipeline {
+	return &Pipeline{stages: []pipelineStage{{engine: first}}}
+}
+
+// Then appends a stage. mapping maps currencies of the previous stage's
+// summary to vars of next, e.g. {"USD": "network_fee"}. Totals are handed off
+// as exact decimal.Decimal values. A mapped currency missing from the summary
+// is not an error: the previous stage charged nothing in it, so its var is set
+// to a zero decimal.
+func (p *Pipeline) Then(next *FeeEngine, mapping map[string]string) *Pipeline {
+	p.stages = append(p.stages, pipelineStage{engine: next, mapping: mapping})
+	return p
+}
+
+// Run executes the remaining rules of each stage in order. Call Reset on the
+// engines before running the pipeline again.
+func (p *Pipeline) Run() (*PipelineResult, error) {
+	out := &PipelineResult{
+		Stages:   make([]*ExecuteResult, 0, len(p.stages)),
+		FeeItems: make([]FeeItem, 0),
+	}
+	var prev *ExecuteResult
+	for i, stage := range p.stages {
+		if prev != nil {
+			for currency, name := range stage.mapping {
+				total := decimal.Zero
+				for _, item := range prev.Summary {
+					if item.Currency == normalizeCurrency(currency) {
+						total = item.Amount
+					}
+				}
+				stage.engine.SetVar(name, total)
+			}
+		}
+
+		result, err := stage.engine.Execute()
+		if err != nil {
+			return nil, fmt.Errorf("pipeline stage %d: %w", i, err)
+		}
+		out.Stages = append(out.Stages, result)
+		out.FeeItems = append(out.FeeItems, result.FeeItems...)
+		prev = result
+	}
+	out.Summary = p.stages[len(p.stages)-1].engine.summarizeFeeItems(out.FeeItems)
+	return out, nil
+}
@@ -0,0 +1,47 @@
+package feecalc
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPipeline_Run(t *testing.T) {
+	network := New(nil).SetVar("amount", 1000.0)
+	network.AddRule(`$(amount * 0.001, "USD")`, `$(2.0, "USD")`)
+
+	platform := New(nil)
+	platform.AddRule(`$(network_fee * 0.5, "USD")`, `$(1.0, "EUR")`)
+
+	result, err := NewPipeline(network).
+		Then(platform, map[string]string{"USD": "network_fee", "GBP": "gbp_fee"}).
+		Run()
+	if err != nil {
+		t.Fatalf("Run failed: %v", err)
+	}
+
+	if len(result.Stages) != 2 {
+		t.Fatalf("Expected 2 stage results, got %d", len(result.Stages))
+	}
+
+	got, _ := platform.GetVar("network_fee")
+	if networkFee, ok := got.(decimal.Decimal); !ok || !networkFee.Equal(decimal.RequireFromString("3")) {
+		t.Errorf("Expected network_fee var to be decimal 3, got %#v", got)
+	}
+	got, _ = platform.GetVar("gbp_fee")
+	if gbpFee, ok := got.(decimal.Decimal); !ok || !gbpFee.IsZero() {
+		t.Errorf("Expected missing GBP total to hand off decimal 0, got %#v", got)
+	}
+
+	if len(result.FeeItems) != 4 {
+		t.Fatalf("Expected 4 combined fee items, got %d", len(result.FeeItems))
+	}
+
+	if total := findAmountByCurrency(result.Summary, "USD"); !total.Equal(decimal.RequireFromString("4.5")) {
+		t.Errorf("Expected combined USD total 4.5, got %s", total.String())
+	}
+
+	if total := findAmountByCurrency(result.Summary, "EUR"); !total.Equal(decimal.NewFromInt(1)) {
+		t.Errorf("Expected combined EUR total 1, got %s", total.String())
+	}
+}
@@ -0,0 +1,52 @@
+package feecalc
+
+import "time"
+
+// ProfileReport aggregates execution statistics across Execute/ExecuteN calls
+type ProfileReport struct {
+	Runs           int           `json:"runs"`
+	ProcessedRules int           `json:"processed_rules"`
+	Duration       time.Duration `json:"duration"`
+	AvgRulesPerRun float64       `json:"avg_rules_per_run"`
+	AvgDuration    time.Duration `json:"avg_duration"`
+}
+
+// profiler accumulates run counts and timing for an engine
+type profiler struct {
+	runs     int
+	rules    int
+	duration time.Duration
+}
+
+// record adds a single run to the profiler
+func (p *profiler) record(rules int, elapsed time.Duration) {
+	p.runs++
+	p.rules += rules
+	p.duration += elapsed
+}
+
+// report builds a ProfileReport from the accumulated counters
+func (p *profiler) report() ProfileReport {
+	r := ProfileReport{
+		Runs:           p.runs,
+		ProcessedRules: p.rules,
+		Duration:       p.duration,
+	}
+	if p.runs > 0 {
+		r.AvgRulesPerRun = float64(p.rules) / float64(p.runs)
+		r.AvgDuration = p.duration / time.Duration(p.runs)
+	}
+	return r
+}
+
+// Profile returns statistics aggregated since the engine was created or
+// ResetProfile was last called
+func (e *FeeEngine) Profile() ProfileReport {
+	return e.profiler.report()
+}
+
+// ResetProfile clears the aggregated statistics
+func (e *FeeEngine) ResetProfile() *FeeEngine {
+	e.profiler = profiler{}
+	return e
+}
@@ -0,0 +1,149 @@
+package feecalc
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative -I proto proto/feecalc.proto
+
+import (
+	"encoding/json"
+	"fmt"
+
+	feecalcpb "github.com/noru/feecalc/proto"
+	"github.com/shopspring/decimal"
+)
+
+// ToProto converts the result to the feecalcpb.ExecuteResult message generated
+// from proto/feecalc.proto. Amounts are kept as decimal strings and vars as JSON.
+func (r *ExecuteResult) ToProto() (*feecalcpb.ExecuteResult, error) {
+	msg := &feecalcpb.ExecuteResult{
+		ProcessedRules: int64(r.ProcessedRules),
+		FeeItems:       feeItemsToProto(r.FeeItems),
+		Summary:        feeItemsToProto(r.Summary),
+		Warnings:       r.Warnings,
+		Halted:         r.Halted,
+		TxId:           r.TxID,
+	}
+	for _, l := range r.Logs {
+		pl, err := logToProto(l)
+		if err != nil {
+			return nil, err
+		}
+		msg.Logs = append(msg.Logs, pl)
+	}
+	if r.Context != nil {
+		r.Context.mu.RLock()
+		vars, err := json.Marshal(r.Context.Vars)
+		r.Context.mu.RUnlock()
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode context vars: %w", err)
+		}
+		msg.VarsJson = vars
+	}
+	return msg, nil
+}
+
+// FromProto converts a message produced by ToProto back to a result. Vars are
+// decoded from JSON, so numbers come back as float64.
+func FromProto(msg *feecalcpb.ExecuteResult) (*ExecuteResult, error) {
+	r := &ExecuteResult{
+		ProcessedRules: int(msg.GetProcessedRules()),
+		Logs:           make([]Log, 0, len(msg.GetLogs())),
+		Warnings:       msg.GetWarnings(),
+		Halted:         msg.GetHalted(),
+		TxID:           msg.GetTxId(),
+	}
+	var err error
+	if r.FeeItems, err = feeItemsFromProto(msg.GetFeeItems()); err != nil {
+		return nil, fmt.Errorf("failed to decode result: %w", err)
+	}
+	if r.Summary, err = feeItemsFromProto(msg.GetSummary()); err != nil {
+		return nil, fmt.Errorf("failed to decode result: %w", err)
+	}
+	for _, pl := range msg.GetLogs() {
+		l, err := logFromProto(pl)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode result: %w", err)
+		}
+		r.Logs = append(r.Logs, l)
+	}
+
+	ctx := &Context{Vars: make(map[string]interface{}), FeeItems: make([]FeeItem, 0), Logs: make([]Log, 0)}
+	if vars := msg.GetVarsJson(); len(vars) > 0 {
+		if err := json.Unmarshal(vars, &ctx.Vars); err != nil {
+			return nil, fmt.Errorf("failed to decode context vars: %w", err)
+		}
+	}
+	ctx.FeeItems = append(ctx.FeeItems, r.FeeItems...)
+	ctx.Logs = append(ctx.Logs, r.Logs...)
+	ctx.TxID = r.TxID
+	r.Context = ctx
+	return r, nil
+}
+
+func feeItemsToProto(items []FeeItem) []*feecalcpb.FeeItem {
+	out := make([]*feecalcpb.FeeItem, 0, len(items))
+	for _, item := range items {
+		out = append(out, &feecalcpb.FeeItem{
+			Amount:   item.Amount.String(),
+			Currency: string(item.Currency),
+			Label:    item.Label,
+			Tags:     item.Tags,
+			Bucket:   item.Bucket,
+		})
+	}
+	return out
+}
+
+func feeItemsFromProto(items []*feecalcpb.FeeItem) ([]FeeItem, error) {
+	out := make([]FeeItem, 0, len(items))
+	for _, pi := range items {
+		amount, err := decimal.NewFromString(pi.GetAmount())
+		if err != nil {
+			return nil, fmt.Errorf("invalid fee amount %q: %w", pi.GetAmount(), err)
+		}
+		out = append(out, FeeItem{
+			Amount:   amount,
+			Currency: Currency(pi.GetCurrency()),
+			Label:    pi.GetLabel(),
+			Tags:     pi.GetTags(),
+			Bucket:   pi.GetBucket(),
+		})
+	}
+	return out, nil
+}
+
+func logToProto(l Log) (*feecalcpb.Log, error) {
+	pl := &feecalcpb.Log{
+		Rule:         l.Rule,
+		Preprocessed: l.Preprocessed,
+		FeeItems:     feeItemsToProto(l.FeeItems),
+		TxId:         l.TxID,
+	}
+	if l.Vars != nil {
+		vars, err := json.Marshal(decimalEncoder{asString: true}.vars(l.Vars))
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode log vars: %w", err)
+		}
+		pl.VarsJson = vars
+	}
+	return pl, nil
+}
+
+func logFromProto(pl *feecalcpb.Log) (Log, error) {
+	l := Log{
+		Rule:         pl.GetRule(),
+		Preprocessed: pl.GetPreprocessed(),
+		TxID:         pl.GetTxId(),
+	}
+	if vars := pl.GetVarsJson(); len(vars) > 0 {
+		if err := json.Unmarshal(vars, &l.Vars); err != nil {
+			return Log{}, fmt.Errorf("failed to decode log vars: %w", err)
+		}
+	}
+	items, err := feeItemsFromProto(pl.GetFeeItems())
+	if err != nil {
+		return Log{}, err
+	}
+	if len(items) > 0 {
+		l.FeeItems = items
+	}
+	return l, nil
+}
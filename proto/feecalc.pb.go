@@ -0,0 +1,367 @@
+// Wire format of feecalc results, produced by ExecuteResult.ToProto and read
+// by FromProto. The Go types in the feecalc package are the source of truth;
+// keep this file in sync with proto.go.
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        (unknown)
+// source: feecalc.proto
+
+package feecalcpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type FeeItem struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Decimal amount as a string to preserve precision, e.g. "12.345"
+	Amount        string            `protobuf:"bytes,1,opt,name=amount,proto3" json:"amount,omitempty"`
+	Currency      string            `protobuf:"bytes,2,opt,name=currency,proto3" json:"currency,omitempty"`
+	Label         string            `protobuf:"bytes,3,opt,name=label,proto3" json:"label,omitempty"`
+	Tags          map[string]string `protobuf:"bytes,4,rep,name=tags,proto3" json:"tags,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
+	Bucket        string            `protobuf:"bytes,5,opt,name=bucket,proto3" json:"bucket,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *FeeItem) Reset() {
+	*x = FeeItem{}
+	mi := &file_feecalc_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *FeeItem) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*FeeItem) ProtoMessage() {}
+
+func (x *FeeItem) ProtoReflect() protoreflect.Message {
+	mi := &file_feecalc_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use FeeItem.ProtoReflect.Descriptor instead.
+func (*FeeItem) Descriptor() ([]byte, []int) {
+	return file_feecalc_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *FeeItem) GetAmount() string {
+	if x != nil {
+		return x.Amount
+	}
+	return ""
+}
+
+func (x *FeeItem) GetCurrency() string {
+	if x != nil {
+		return x.Currency
+	}
+	return ""
+}
+
+func (x *FeeItem) GetLabel() string {
+	if x != nil {
+		return x.Label
+	}
+	return ""
+}
+
+func (x *FeeItem) GetTags() map[string]string {
+	if x != nil {
+		return x.Tags
+	}
+	return nil
+}
+
+func (x *FeeItem) GetBucket() string {
+	if x != nil {
+		return x.Bucket
+	}
+	return ""
+}
+
+type Log struct {
+	state        protoimpl.MessageState `protogen:"open.v1"`
+	Rule         string                 `protobuf:"bytes,1,opt,name=rule,proto3" json:"rule,omitempty"`
+	Preprocessed string                 `protobuf:"bytes,2,opt,name=preprocessed,proto3" json:"preprocessed,omitempty"`
+	// Var snapshot as a JSON object
+	VarsJson      []byte     `protobuf:"bytes,3,opt,name=vars_json,json=varsJson,proto3" json:"vars_json,omitempty"`
+	FeeItems      []*FeeItem `protobuf:"bytes,4,rep,name=fee_items,json=feeItems,proto3" json:"fee_items,omitempty"`
+	TxId          string     `protobuf:"bytes,5,opt,name=tx_id,json=txId,proto3" json:"tx_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Log) Reset() {
+	*x = Log{}
+	mi := &file_feecalc_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Log) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Log) ProtoMessage() {}
+
+func (x *Log) ProtoReflect() protoreflect.Message {
+	mi := &file_feecalc_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Log.ProtoReflect.Descriptor instead.
+func (*Log) Descriptor() ([]byte, []int) {
+	return file_feecalc_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *Log) GetRule() string {
+	if x != nil {
+		return x.Rule
+	}
+	return ""
+}
+
+func (x *Log) GetPreprocessed() string {
+	if x != nil {
+		return x.Preprocessed
+	}
+	return ""
+}
+
+func (x *Log) GetVarsJson() []byte {
+	if x != nil {
+		return x.VarsJson
+	}
+	return nil
+}
+
+func (x *Log) GetFeeItems() []*FeeItem {
+	if x != nil {
+		return x.FeeItems
+	}
+	return nil
+}
+
+func (x *Log) GetTxId() string {
+	if x != nil {
+		return x.TxId
+	}
+	return ""
+}
+
+type ExecuteResult struct {
+	state          protoimpl.MessageState `protogen:"open.v1"`
+	ProcessedRules int64                  `protobuf:"varint,1,opt,name=processed_rules,json=processedRules,proto3" json:"processed_rules,omitempty"`
+	Logs           []*Log                 `protobuf:"bytes,2,rep,name=logs,proto3" json:"logs,omitempty"`
+	FeeItems       []*FeeItem             `protobuf:"bytes,3,rep,name=fee_items,json=feeItems,proto3" json:"fee_items,omitempty"`
+	Summary        []*FeeItem             `protobuf:"bytes,4,rep,name=summary,proto3" json:"summary,omitempty"`
+	Warnings       []string               `protobuf:"bytes,5,rep,name=warnings,proto3" json:"warnings,omitempty"`
+	Halted         bool                   `protobuf:"varint,6,opt,name=halted,proto3" json:"halted,omitempty"`
+	// Context vars as a JSON object
+	VarsJson      []byte `protobuf:"bytes,7,opt,name=vars_json,json=varsJson,proto3" json:"vars_json,omitempty"`
+	TxId          string `protobuf:"bytes,8,opt,name=tx_id,json=txId,proto3" json:"tx_id,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ExecuteResult) Reset() {
+	*x = ExecuteResult{}
+	mi := &file_feecalc_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ExecuteResult) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ExecuteResult) ProtoMessage() {}
+
+func (x *ExecuteResult) ProtoReflect() protoreflect.Message {
+	mi := &file_feecalc_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ExecuteResult.ProtoReflect.Descriptor instead.
+func (*ExecuteResult) Descriptor() ([]byte, []int) {
+	return file_feecalc_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *ExecuteResult) GetProcessedRules() int64 {
+	if x != nil {
+		return x.ProcessedRules
+	}
+	return 0
+}
+
+func (x *ExecuteResult) GetLogs() []*Log {
+	if x != nil {
+		return x.Logs
+	}
+	return nil
+}
+
+func (x *ExecuteResult) GetFeeItems() []*FeeItem {
+	if x != nil {
+		return x.FeeItems
+	}
+	return nil
+}
+
+func (x *ExecuteResult) GetSummary() []*FeeItem {
+	if x != nil {
+		return x.Summary
+	}
+	return nil
+}
+
+func (x *ExecuteResult) GetWarnings() []string {
+	if x != nil {
+		return x.Warnings
+	}
+	return nil
+}
+
+func (x *ExecuteResult) GetHalted() bool {
+	if x != nil {
+		return x.Halted
+	}
+	return false
+}
+
+func (x *ExecuteResult) GetVarsJson() []byte {
+	if x != nil {
+		return x.VarsJson
+	}
+	return nil
+}
+
+func (x *ExecuteResult) GetTxId() string {
+	if x != nil {
+		return x.TxId
+	}
+	return ""
+}
+
+var File_feecalc_proto protoreflect.FileDescriptor
+
+const file_feecalc_proto_rawDesc = "" +
+	"\n" +
+	"\rfeecalc.proto\x12\afeecalc\"\xd4\x01\n" +
+	"\aFeeItem\x12\x16\n" +
+	"\x06amount\x18\x01 \x01(\tR\x06amount\x12\x1a\n" +
+	"\bcurrency\x18\x02 \x01(\tR\bcurrency\x12\x14\n" +
+	"\x05label\x18\x03 \x01(\tR\x05label\x12.\n" +
+	"\x04tags\x18\x04 \x03(\v2\x1a.feecalc.FeeItem.TagsEntryR\x04tags\x12\x16\n" +
+	"\x06bucket\x18\x05 \x01(\tR\x06bucket\x1a7\n" +
+	"\tTagsEntry\x12\x10\n" +
+	"\x03key\x18\x01 \x01(\tR\x03key\x12\x14\n" +
+	"\x05value\x18\x02 \x01(\tR\x05value:\x028\x01\"\x9e\x01\n" +
+	"\x03Log\x12\x12\n" +
+	"\x04rule\x18\x01 \x01(\tR\x04rule\x12\"\n" +
+	"\fpreprocessed\x18\x02 \x01(\tR\fpreprocessed\x12\x1b\n" +
+	"\tvars_json\x18\x03 \x01(\fR\bvarsJson\x12-\n" +
+	"\tfee_items\x18\x04 \x03(\v2\x10.feecalc.FeeItemR\bfeeItems\x12\x13\n" +
+	"\x05tx_id\x18\x05 \x01(\tR\x04txId\"\x9b\x02\n" +
+	"\rExecuteResult\x12'\n" +
+	"\x0fprocessed_rules\x18\x01 \x01(\x03R\x0eprocessedRules\x12 \n" +
+	"\x04logs\x18\x02 \x03(\v2\f.feecalc.LogR\x04logs\x12-\n" +
+	"\tfee_items\x18\x03 \x03(\v2\x10.feecalc.FeeItemR\bfeeItems\x12*\n" +
+	"\asummary\x18\x04 \x03(\v2\x10.feecalc.FeeItemR\asummary\x12\x1a\n" +
+	"\bwarnings\x18\x05 \x03(\tR\bwarnings\x12\x16\n" +
+	"\x06halted\x18\x06 \x01(\bR\x06halted\x12\x1b\n" +
+	"\tvars_json\x18\a \x01(\fR\bvarsJson\x12\x13\n" +
+	"\x05tx_id\x18\b \x01(\tR\x04txIdB)Z'github.com/noru/feecalc/proto;feecalcpbb\x06proto3"
+
+var (
+	file_feecalc_proto_rawDescOnce sync.Once
+	file_feecalc_proto_rawDescData []byte
+)
+
+func file_feecalc_proto_rawDescGZIP() []byte {
+	file_feecalc_proto_rawDescOnce.Do(func() {
+		file_feecalc_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_feecalc_proto_rawDesc), len(file_feecalc_proto_rawDesc)))
+	})
+	return file_feecalc_proto_rawDescData
+}
+
+var file_feecalc_proto_msgTypes = make([]protoimpl.MessageInfo, 4)
+var file_feecalc_proto_goTypes = []any{
+	(*FeeItem)(nil),       // 0: feecalc.FeeItem
+	(*Log)(nil),           // 1: feecalc.Log
+	(*ExecuteResult)(nil), // 2: feecalc.ExecuteResult
+	nil,                   // 3: feecalc.FeeItem.TagsEntry
+}
+var file_feecalc_proto_depIdxs = []int32{
+	3, // 0: feecalc.FeeItem.tags:type_name -> feecalc.FeeItem.TagsEntry
+	0, // 1: feecalc.Log.fee_items:type_name -> feecalc.FeeItem
+	1, // 2: feecalc.ExecuteResult.logs:type_name -> feecalc.Log
+	0, // 3: feecalc.ExecuteResult.fee_items:type_name -> feecalc.FeeItem
+	0, // 4: feecalc.ExecuteResult.summary:type_name -> feecalc.FeeItem
+	5, // [5:5] is the sub-list for method output_type
+	5, // [5:5] is the sub-list for method input_type
+	5, // [5:5] is the sub-list for extension type_name
+	5, // [5:5] is the sub-list for extension extendee
+	0, // [0:5] is the sub-list for field type_name
+}
+
+func init() { file_feecalc_proto_init() }
+func file_feecalc_proto_init() {
+	if File_feecalc_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_feecalc_proto_rawDesc), len(file_feecalc_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   4,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_feecalc_proto_goTypes,
+		DependencyIndexes: file_feecalc_proto_depIdxs,
+		MessageInfos:      file_feecalc_proto_msgTypes,
+	}.Build()
+	File_feecalc_proto = out.File
+	file_feecalc_proto_goTypes = nil
+	file_feecalc_proto_depIdxs = nil
+}
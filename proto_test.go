@@ -0,0 +1,76 @@
+package feecalc
+
+import (
+	"reflect"
+	"testing"
+
+	feecalcpb "github.com/noru/feecalc/proto"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestProto_RoundTrip(t *testing.T) {
+	engine := New(nil).EnableLog().SetVar("amount", 1000.0)
+	engine.AddRule(
+		`$(amount * 0.0123, "USD")`,
+		`fee = 2.5`,
+		`[$(fee, "EUR"), TaggedFee(1.25, "KES", {"type": "network"})]`,
+		`Split(10, "USD", {"platform": 0.7, "partner": 0.3})`,
+		`BucketFee(0.5, "USD", "US-CA")`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	msg, err := result.ToProto()
+	if err != nil {
+		t.Fatalf("ToProto failed: %v", err)
+	}
+	data, err := proto.Marshal(msg)
+	if err != nil {
+		t.Fatalf("proto.Marshal failed: %v", err)
+	}
+
+	var wire feecalcpb.ExecuteResult
+	if err := proto.Unmarshal(data, &wire); err != nil {
+		t.Fatalf("proto.Unmarshal failed: %v", err)
+	}
+	decoded, err := FromProto(&wire)
+	if err != nil {
+		t.Fatalf("FromProto failed: %v", err)
+	}
+
+	if decoded.ProcessedRules != result.ProcessedRules {
+		t.Errorf("Expected %d processed rules, got %d", result.ProcessedRules, decoded.ProcessedRules)
+	}
+
+	compareItems := func(name string, want, got []FeeItem) {
+		if len(want) != len(got) {
+			t.Fatalf("Expected %d %s, got %d", len(want), name, len(got))
+		}
+		for i := range want {
+			if !want[i].Amount.Equal(got[i].Amount) || want[i].Currency != got[i].Currency ||
+				want[i].Label != got[i].Label || !reflect.DeepEqual(want[i].Tags, got[i].Tags) ||
+				want[i].Bucket != got[i].Bucket {
+				t.Errorf("Expected %s %d to be %+v, got %+v", name, i, want[i], got[i])
+			}
+		}
+	}
+	compareItems("fee items", result.FeeItems, decoded.FeeItems)
+	compareItems("summary lines", result.Summary, decoded.Summary)
+
+	if len(decoded.Logs) != len(result.Logs) {
+		t.Fatalf("Expected %d logs, got %d", len(result.Logs), len(decoded.Logs))
+	}
+	for i := range result.Logs {
+		if decoded.Logs[i].Rule != result.Logs[i].Rule || decoded.Logs[i].Preprocessed != result.Logs[i].Preprocessed {
+			t.Errorf("Expected log %d to match, got %+v", i, decoded.Logs[i])
+		}
+		compareItems("log fee items", result.Logs[i].FeeItems, decoded.Logs[i].FeeItems)
+	}
+
+	if !decoded.Context.Equal(result.Context) {
+		t.Error("Expected decoded context to equal the original")
+	}
+}
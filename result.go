@@ -0,0 +1,445 @@
+package feecalc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// Negated returns a copy of the result's fee items with every amount negated,
+// e.g. to build a refund entry from a charge
+func (r *ExecuteResult) Negated() []FeeItem {
+	items := make([]FeeItem, len(r.FeeItems))
+	for i, item := range r.FeeItems {
+		item.Amount = item.Amount.Neg()
+		items[i] = item
+	}
+	return items
+}
+
+// Filter returns copies of the fee items for which pred returns true
+func (r *ExecuteResult) Filter(pred func(FeeItem) bool) []FeeItem {
+	items := make([]FeeItem, 0)
+	for _, item := range r.FeeItems {
+		if pred(item) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// PartitionOption configures ExecuteResult.PartitionBySign
+type PartitionOption func(*partitionConfig)
+
+type partitionConfig struct {
+	zerosAsCharges   bool
+	creditMagnitudes bool
+}
+
+// ZerosAsCharges makes PartitionBySign keep zero amounts as charges instead of
+// dropping them
+func ZerosAsCharges() PartitionOption {
+	return func(c *partitionConfig) { c.zerosAsCharges = true }
+}
+
+// CreditMagnitudes makes PartitionBySign report credits as positive amounts
+func CreditMagnitudes() PartitionOption {
+	return func(c *partitionConfig) { c.creditMagnitudes = true }
+}
+
+// PartitionBySign splits copies of the fee items into charges (positive
+// amounts) and credits (negative amounts), keeping their order. Credits keep
+// their negative sign unless CreditMagnitudes is given, and zero amounts are
+// dropped unless ZerosAsCharges is given.
+func (r *ExecuteResult) PartitionBySign(opts ...PartitionOption) (charges, credits []FeeItem) {
+	var cfg partitionConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	charges = make([]FeeItem, 0)
+	credits = make([]FeeItem, 0)
+	for _, item := range r.FeeItems {
+		switch {
+		case item.Amount.IsNegative():
+			if cfg.creditMagnitudes {
+				item.Amount = item.Amount.Neg()
+			}
+			credits = append(credits, item)
+		case item.Amount.IsPositive() || cfg.zerosAsCharges:
+			charges = append(charges, item)
+		}
+	}
+	return charges, credits
+}
+
+// SummaryByBucket totals the fee items by bucket, then by currency in order
+// of first appearance. Items without a bucket are grouped under "". Zero
+// totals are kept.
+func (r *ExecuteResult) SummaryByBucket() map[string][]FeeItem {
+	lines := make(map[string][]FeeItem)
+	for _, item := range r.FeeItems {
+		lines[item.Bucket] = append(lines[item.Bucket], FeeItem{
+			Amount:   item.Amount,
+			Currency: item.Currency,
+			Bucket:   item.Bucket,
+		})
+	}
+	for bucket, items := range lines {
+		lines[bucket] = normalizeSummary(items, false)
+	}
+	return lines
+}
+
+// MaxFee returns the fee item with the largest absolute amount, preferring the
+// first on ties. ok is false when there are no fee items.
+func (r *ExecuteResult) MaxFee() (item FeeItem, ok bool) {
+	return r.extremeFee(func(a, b decimal.Decimal) bool { return a.GreaterThan(b) })
+}
+
+// MinFee returns the fee item with the smallest absolute amount, preferring the
+// first on ties. ok is false when there are no fee items.
+func (r *ExecuteResult) MinFee() (item FeeItem, ok bool) {
+	return r.extremeFee(func(a, b decimal.Decimal) bool { return a.LessThan(b) })
+}
+
+// extremeFee scans fee items by absolute amount, keeping the first item
+// for which better reports true against the current pick
+func (r *ExecuteResult) extremeFee(better func(a, b decimal.Decimal) bool) (FeeItem, bool) {
+	if len(r.FeeItems) == 0 {
+		return FeeItem{}, false
+	}
+	pick := r.FeeItems[0]
+	for _, item := range r.FeeItems[1:] {
+		if better(item.Amount.Abs(), pick.Amount.Abs()) {
+			pick = item
+		}
+	}
+	return pick, true
+}
+
+// EffectiveRate returns, per currency, the summary total divided by the value
+// baseVar held when execution started, for disclosing the effective
+// percentage charged
+func (r *ExecuteResult) EffectiveRate(baseVar string) (map[string]decimal.Decimal, error) {
+	base, err := r.initialValue(baseVar)
+	if err != nil {
+		return nil, err
+	}
+	if base.IsZero() {
+		return nil, fmt.Errorf("base var %s is zero", baseVar)
+	}
+
+	rates := make(map[string]decimal.Decimal, len(r.Summary))
+	for _, item := range r.Summary {
+		rates[string(item.Currency)] = item.Amount.Div(base)
+	}
+	return rates, nil
+}
+
+// EqualWithin reports whether two fee items have the same currency and amounts
+// differing by at most tolerance
+func (f FeeItem) EqualWithin(other FeeItem, tolerance decimal.Decimal) bool {
+	return f.Currency == other.Currency && f.Amount.Sub(other.Amount).Abs().LessThanOrEqual(tolerance)
+}
+
+// SummaryEqual reports whether two summaries have the same currencies with
+// per-currency totals differing by at most tolerance. Line order is ignored.
+func SummaryEqual(a, b []FeeItem, tolerance decimal.Decimal) bool {
+	totals := func(items []FeeItem) map[Currency]decimal.Decimal {
+		m := make(map[Currency]decimal.Decimal)
+		for _, item := range items {
+			m[item.Currency] = m[item.Currency].Add(item.Amount)
+		}
+		return m
+	}
+	ta, tb := totals(a), totals(b)
+	if len(ta) != len(tb) {
+		return false
+	}
+	for currency, amount := range ta {
+		other, ok := tb[currency]
+		if !ok || amount.Sub(other).Abs().GreaterThan(tolerance) {
+			return false
+		}
+	}
+	return true
+}
+
+// AggregateResults sums the summaries of several results by currency, e.g. to
+// total an ExecuteBatch run. Currencies are ordered by first appearance.
+func AggregateResults(results []*ExecuteResult) []FeeItem {
+	totals := make(map[Currency]decimal.Decimal)
+	order := make([]Currency, 0)
+	for _, r := range results {
+		if r == nil {
+			continue
+		}
+		for _, item := range r.Summary {
+			if _, ok := totals[item.Currency]; !ok {
+				order = append(order, item.Currency)
+			}
+			totals[item.Currency] = totals[item.Currency].Add(item.Amount)
+		}
+	}
+
+	aggregate := make([]FeeItem, 0, len(order))
+	for _, currency := range order {
+		aggregate = append(aggregate, FeeItem{Amount: totals[currency], Currency: currency})
+	}
+	return aggregate
+}
+
+// ResultDiff describes how one result's fees differ from another's
+type ResultDiff struct {
+	// SummaryDeltas holds, per currency, the change in summary total; currencies
+	// whose totals are unchanged are omitted
+	SummaryDeltas map[Currency]decimal.Decimal `json:"summary_deltas"`
+	Added         []FeeItem                    `json:"added"`
+	Removed       []FeeItem                    `json:"removed"`
+	Changed       []FeeItemChange              `json:"changed"`
+}
+
+// FeeItemChange is a fee item whose amount differs between two results
+type FeeItemChange struct {
+	Before FeeItem `json:"before"`
+	After  FeeItem `json:"after"`
+}
+
+// Empty reports whether the diff found no differences
+func (d ResultDiff) Empty() bool {
+	return len(d.SummaryDeltas) == 0 && len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Changed) == 0
+}
+
+// DiffResults compares the fees of result b against result a. Fee items are
+// matched by currency and label in order of appearance; unmatched items are
+// reported as added or removed, and matched items with different amounts as
+// changed. A nil result is treated as having no fees.
+func DiffResults(a, b *ExecuteResult) ResultDiff {
+	diff := ResultDiff{SummaryDeltas: make(map[Currency]decimal.Decimal)}
+	var before, after []FeeItem
+	if a != nil {
+		before = a.FeeItems
+		for _, item := range a.Summary {
+			diff.SummaryDeltas[item.Currency] = diff.SummaryDeltas[item.Currency].Sub(item.Amount)
+		}
+	}
+	if b != nil {
+		after = b.FeeItems
+		for _, item := range b.Summary {
+			diff.SummaryDeltas[item.Currency] = diff.SummaryDeltas[item.Currency].Add(item.Amount)
+		}
+	}
+	for currency, delta := range diff.SummaryDeltas {
+		if delta.IsZero() {
+			delete(diff.SummaryDeltas, currency)
+		}
+	}
+
+	type itemKey struct {
+		currency Currency
+		label    string
+	}
+	pending := make(map[itemKey][]FeeItem)
+	for _, item := range before {
+		k := itemKey{item.Currency, item.Label}
+		pending[k] = append(pending[k], item)
+	}
+	for _, item := range after {
+		k := itemKey{item.Currency, item.Label}
+		if len(pending[k]) == 0 {
+			diff.Added = append(diff.Added, item)
+			continue
+		}
+		prev := pending[k][0]
+		pending[k] = pending[k][1:]
+		if !prev.Amount.Equal(item.Amount) {
+			diff.Changed = append(diff.Changed, FeeItemChange{Before: prev, After: item})
+		}
+	}
+	for _, item := range before {
+		k := itemKey{item.Currency, item.Label}
+		if len(pending[k]) > 0 {
+			diff.Removed = append(diff.Removed, pending[k][0])
+			pending[k] = pending[k][1:]
+		}
+	}
+	return diff
+}
+
+// NetAmount returns the value baseVar held when execution started minus the
+// summary total for currency, e.g. the amount a merchant receives. Negative
+// fees such as discounts increase the net amount.
+func (r *ExecuteResult) NetAmount(baseVar, currency string) (decimal.Decimal, error) {
+	base, err := r.initialValue(baseVar)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	target := normalizeCurrency(currency)
+	for _, item := range r.Summary {
+		if item.Currency == target {
+			base = base.Sub(item.Amount)
+		}
+	}
+	return base, nil
+}
+
+// MeetsMinimum reports whether the net amount in currency (see NetAmount),
+// taken from the engine's base var, is at least min, and otherwise how much it
+// falls short by. It returns the NetAmount error when the result has no
+// starting value for the base var.
+func (r *ExecuteResult) MeetsMinimum(currency string, min decimal.Decimal) (bool, decimal.Decimal, error) {
+	baseVar := r.baseVar
+	if baseVar == "" {
+		baseVar = "amount"
+	}
+	net, err := r.NetAmount(baseVar, currency)
+	if err != nil {
+		return false, decimal.Zero, err
+	}
+	if net.LessThan(min) {
+		return false, min.Sub(net), nil
+	}
+	return true, decimal.Zero, nil
+}
+
+// initialValue returns the value of a var captured at execution start
+func (r *ExecuteResult) initialValue(name string) (decimal.Decimal, error) {
+	if r.Context == nil {
+		return decimal.Zero, fmt.Errorf("result has no context")
+	}
+
+	r.Context.mu.RLock()
+	value, ok := r.Context.initialVars[name]
+	r.Context.mu.RUnlock()
+	if !ok {
+		return decimal.Zero, &MissingVarError{Name: name}
+	}
+	return toDecimal(value), nil
+}
+
+// MarshalResult encodes a result as JSON, writing every decimal amount (in fee
+// items, summary, logs and context vars) either as a JSON string or as a bare
+// JSON number. Strings are safest for consumers that parse numbers as floats.
+func MarshalResult(result *ExecuteResult, numbersAsStrings bool) ([]byte, error) {
+	if result == nil {
+		return []byte("null"), nil
+	}
+
+	enc := decimalEncoder{asString: numbersAsStrings}
+	out := resultJSON{
+		ExecuteResult: result,
+		Logs:          enc.logs(result.Logs),
+		FeeItems:      enc.feeItems(result.FeeItems),
+		Summary:       enc.feeItems(result.Summary),
+	}
+	if result.Context != nil {
+		result.Context.mu.RLock()
+		defer result.Context.mu.RUnlock()
+		out.Context = &contextJSON{
+			Context:  result.Context,
+			Vars:     enc.vars(result.Context.Vars),
+			FeeItems: enc.feeItems(result.Context.FeeItems),
+			Logs:     enc.logs(result.Context.Logs),
+		}
+	}
+	return json.Marshal(out)
+}
+
+// The JSON mirror types embed the original type and shadow only the fields
+// holding decimals, so other fields are encoded as usual
+
+type feeItemJSON struct {
+	FeeItem
+	Amount json.RawMessage `json:"amount"`
+}
+
+// logFields has Log's fields without its MarshalJSON method
+type logFields Log
+
+type logJSON struct {
+	logFields
+	Vars     map[string]interface{} `json:"vars"`
+	FeeItems []feeItemJSON          `json:"fee_items"`
+}
+
+type contextJSON struct {
+	*Context
+	Vars     map[string]interface{} `json:"vars"`
+	FeeItems []feeItemJSON          `json:"fee_items"`
+	Logs     []logJSON              `json:"logs"`
+}
+
+type resultJSON struct {
+	*ExecuteResult
+	Logs     []logJSON     `json:"logs"`
+	FeeItems []feeItemJSON `json:"fee_items"`
+	Summary  []feeItemJSON `json:"summary"`
+	Context  *contextJSON  `json:"context"`
+}
+
+// MarshalJSON encodes the log with decimal vars as exact strings, so logs
+// serialize the same regardless of decimal.MarshalJSONWithoutQuotes. Use
+// MarshalResult to write them as numbers instead.
+func (l Log) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		logFields
+		Vars map[string]interface{} `json:"vars"`
+	}{logFields(l), decimalEncoder{asString: true}.vars(l.Vars)})
+}
+
+// decimalEncoder converts decimals to raw JSON strings or numbers
+type decimalEncoder struct {
+	asString bool
+}
+
+func (d decimalEncoder) encode(v decimal.Decimal) json.RawMessage {
+	if d.asString {
+		return json.RawMessage(`"` + v.String() + `"`)
+	}
+	return json.RawMessage(v.String())
+}
+
+func (d decimalEncoder) feeItems(items []FeeItem) []feeItemJSON {
+	if items == nil {
+		return nil
+	}
+	out := make([]feeItemJSON, len(items))
+	for i, item := range items {
+		out[i] = feeItemJSON{FeeItem: item, Amount: d.encode(item.Amount)}
+	}
+	return out
+}
+
+func (d decimalEncoder) vars(vars map[string]interface{}) map[string]interface{} {
+	if vars == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(vars))
+	for k, v := range vars {
+		switch val := v.(type) {
+		case decimal.Decimal:
+			out[k] = d.encode(val)
+		case *decimal.Decimal:
+			if val != nil {
+				out[k] = d.encode(*val)
+			} else {
+				out[k] = nil
+			}
+		default:
+			out[k] = v
+		}
+	}
+	return out
+}
+
+func (d decimalEncoder) logs(logs []Log) []logJSON {
+	if logs == nil {
+		return nil
+	}
+	out := make([]logJSON, len(logs))
+	for i, l := range logs {
+		out[i] = logJSON{logFields: logFields(l), Vars: d.vars(l.Vars), FeeItems: d.feeItems(l.FeeItems)}
+	}
+	return out
+}
@@ -0,0 +1,528 @@
+package feecalc
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestExecuteResult_Negated(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`[$(100.0, "USD"), $(-20.0, "USD"), $(35.5, "EUR")]`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	negated := result.Negated()
+	if len(negated) != len(result.FeeItems) {
+		t.Fatalf("Expected %d negated items, got %d", len(result.FeeItems), len(negated))
+	}
+
+	for i, item := range negated {
+		original := result.FeeItems[i]
+		if !item.Amount.Equal(original.Amount.Mul(decimal.NewFromInt(-1))) {
+			t.Errorf("Expected item %d amount %s, got %s", i, original.Amount.Neg().String(), item.Amount.String())
+		}
+		if item.Currency != original.Currency {
+			t.Errorf("Expected item %d currency %s, got %s", i, original.Currency, item.Currency)
+		}
+	}
+
+	if !result.FeeItems[0].Amount.Equal(decimal.NewFromInt(100)) {
+		t.Errorf("Expected original items to be unchanged, got %s", result.FeeItems[0].Amount.String())
+	}
+}
+
+func TestExecuteResult_Filter(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`[$(10.0, "USD"), $(-2.0, "USD"), $(5.0, "EUR"), $(-1.0, "EUR")]`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	discounts := result.Filter(func(item FeeItem) bool { return item.Amount.IsNegative() })
+	if len(discounts) != 2 {
+		t.Fatalf("Expected 2 negative fees, got %d", len(discounts))
+	}
+	if !discounts[0].Amount.Equal(decimal.NewFromInt(-2)) || !discounts[1].Amount.Equal(decimal.NewFromInt(-1)) {
+		t.Errorf("Expected discounts -2 and -1, got %s and %s", discounts[0].Amount.String(), discounts[1].Amount.String())
+	}
+
+	eur := result.Filter(func(item FeeItem) bool { return item.Currency == "EUR" })
+	if len(eur) != 2 || eur[0].Currency != "EUR" || eur[1].Currency != "EUR" {
+		t.Errorf("Expected 2 EUR fees, got %+v", eur)
+	}
+
+	discounts[0].Amount = decimal.Zero
+	if !result.FeeItems[1].Amount.Equal(decimal.NewFromInt(-2)) {
+		t.Error("Expected filtered items to be copies")
+	}
+}
+
+func TestExecuteResult_PartitionBySign(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(
+		`$(100, "USD")`,
+		`TaggedFee(-15, "USD", {"type": "coupon"})`,
+		`$(0, "USD")`,
+		`$(2.5, "EUR")`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	charges, credits := result.PartitionBySign()
+	if len(charges) != 2 || len(credits) != 1 {
+		t.Fatalf("Expected 2 charges and 1 credit, got %v and %v", charges, credits)
+	}
+
+	if !charges[0].Amount.Equal(decimal.NewFromInt(100)) || charges[1].Currency != "EUR" {
+		t.Errorf("Unexpected charges: %v", charges)
+	}
+
+	if credits[0].Tags["type"] != "coupon" || !credits[0].Amount.Equal(decimal.NewFromInt(-15)) {
+		t.Errorf("Expected the coupon credit of -15, got %v", credits[0])
+	}
+
+	charges, credits = result.PartitionBySign(ZerosAsCharges(), CreditMagnitudes())
+	if len(charges) != 3 {
+		t.Errorf("Expected the zero item as a charge, got %v", charges)
+	}
+
+	if !credits[0].Amount.Equal(decimal.NewFromInt(15)) {
+		t.Errorf("Expected credit magnitude 15, got %s", credits[0].Amount.String())
+	}
+
+	if !result.FeeItems[1].Amount.Equal(decimal.NewFromInt(-15)) {
+		t.Errorf("Expected result fee items unchanged, got %s", result.FeeItems[1].Amount.String())
+	}
+}
+
+func TestExecuteResult_SummaryByBucket(t *testing.T) {
+	engine := New(nil).SetVar("amount", 1000.0)
+	engine.AddRule(
+		`BucketFee(amount * 0.06, "USD", "US-CA")`,
+		`BucketFee(amount * 0.0725, "USD", "US-NY")`,
+		`BucketFee(amount * 0.01, "USD", "US-CA")`,
+		`BucketFee(2, "EUR", "US-CA")`,
+		`$(5, "USD")`,
+	)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	buckets := result.SummaryByBucket()
+	if len(buckets) != 3 {
+		t.Fatalf("Expected 3 buckets, got %v", buckets)
+	}
+
+	expected := map[string]map[Currency]string{
+		"US-CA": {"USD": "70", "EUR": "2"},
+		"US-NY": {"USD": "72.5"},
+		"":      {"USD": "5"},
+	}
+	for bucket, totals := range expected {
+		lines := buckets[bucket]
+		if len(lines) != len(totals) {
+			t.Errorf("Bucket %q: expected %d lines, got %v", bucket, len(totals), lines)
+			continue
+		}
+		for currency, want := range totals {
+			if got := findAmountByCurrency(lines, currency); !got.Equal(decimal.RequireFromString(want)) {
+				t.Errorf("Bucket %q: expected %s %s, got %s", bucket, want, currency, got.String())
+			}
+		}
+	}
+
+	if buckets["US-CA"][0].Currency != "USD" {
+		t.Errorf("Expected US-CA lines in order of first appearance, got %v", buckets["US-CA"])
+	}
+}
+
+func TestExecuteResult_MaxMinFee(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`[$(10.0, "USD"), $(-25.0, "USD"), $(25.0, "EUR"), $(-2.0, "USD"), $(2.0, "EUR")]`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	maxFee, ok := result.MaxFee()
+	if !ok || !maxFee.Amount.Equal(decimal.NewFromInt(-25)) || maxFee.Currency != "USD" {
+		t.Errorf("Expected max fee -25 USD, got %+v (ok=%v)", maxFee, ok)
+	}
+
+	minFee, ok := result.MinFee()
+	if !ok || !minFee.Amount.Equal(decimal.NewFromInt(-2)) || minFee.Currency != "USD" {
+		t.Errorf("Expected min fee -2 USD, got %+v (ok=%v)", minFee, ok)
+	}
+
+	empty := &ExecuteResult{}
+	if _, ok := empty.MaxFee(); ok {
+		t.Error("Expected MaxFee to report false for no fee items")
+	}
+	if _, ok := empty.MinFee(); ok {
+		t.Error("Expected MinFee to report false for no fee items")
+	}
+}
+
+func TestExecuteResult_EffectiveRate(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"amount": 1000}})
+	engine.AddRule(`$(amount * 0.02, "USD")`)
+	engine.AddRule(`amount = amount - 20`)
+	engine.AddRule(`$(10, "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	rates, err := result.EffectiveRate("amount")
+	if err != nil {
+		t.Fatalf("EffectiveRate failed: %v", err)
+	}
+
+	if !rates["USD"].Equal(decimal.RequireFromString("0.03")) {
+		t.Errorf("Expected USD effective rate 0.03, got %s", rates["USD"].String())
+	}
+
+	var missing *MissingVarError
+	if _, err := result.EffectiveRate("volume"); !errors.As(err, &missing) {
+		t.Errorf("Expected MissingVarError for unknown base var, got %v", err)
+	}
+}
+
+func TestFeeItem_EqualWithin(t *testing.T) {
+	tol := decimal.RequireFromString("0.0001")
+	a := FeeItem{Amount: decimal.RequireFromString("10.00005"), Currency: "USD"}
+
+	if !a.EqualWithin(FeeItem{Amount: decimal.RequireFromString("10.0001"), Currency: "USD"}, tol) {
+		t.Error("Expected amounts 0.00005 apart to be equal within 0.0001")
+	}
+	if a.EqualWithin(FeeItem{Amount: decimal.RequireFromString("10.0002"), Currency: "USD"}, tol) {
+		t.Error("Expected amounts 0.00015 apart to differ beyond 0.0001")
+	}
+	if a.EqualWithin(FeeItem{Amount: a.Amount, Currency: "EUR"}, tol) {
+		t.Error("Expected different currencies to compare unequal")
+	}
+}
+
+func TestSummaryEqual(t *testing.T) {
+	tol := decimal.RequireFromString("0.0001")
+	a := []FeeItem{
+		{Amount: decimal.RequireFromString("12.3456"), Currency: "USD"},
+		{Amount: decimal.RequireFromString("5"), Currency: "EUR"},
+	}
+	b := []FeeItem{
+		{Amount: decimal.RequireFromString("5.00008"), Currency: "EUR"},
+		{Amount: decimal.RequireFromString("12.34555"), Currency: "USD"},
+	}
+
+	if !SummaryEqual(a, b, tol) {
+		t.Error("Expected summaries within 0.0001 to be equal")
+	}
+
+	b[0].Amount = decimal.RequireFromString("5.0002")
+	if SummaryEqual(a, b, tol) {
+		t.Error("Expected summaries differing by 0.0002 to be unequal")
+	}
+
+	if SummaryEqual(a, a[:1], tol) {
+		t.Error("Expected summaries with different currencies to be unequal")
+	}
+}
+
+func TestDiffResults(t *testing.T) {
+	run := func(rules ...string) *ExecuteResult {
+		engine := New(nil)
+		engine.AddRule(rules...)
+		result, err := engine.Execute()
+		if err != nil {
+			t.Fatalf("Execute failed: %v", err)
+		}
+		return result
+	}
+
+	a := run(`$(10.0, "USD")`, `$(5.0, "USD")`)
+	b := run(`$(10.0, "USD")`, `$(7.0, "USD")`, `$(3.0, "EUR")`)
+
+	diff := DiffResults(a, b)
+
+	if len(diff.SummaryDeltas) != 2 {
+		t.Fatalf("Expected 2 summary deltas, got %v", diff.SummaryDeltas)
+	}
+	if !diff.SummaryDeltas["USD"].Equal(decimal.NewFromInt(2)) {
+		t.Errorf("Expected USD delta 2, got %s", diff.SummaryDeltas["USD"].String())
+	}
+	if !diff.SummaryDeltas["EUR"].Equal(decimal.NewFromInt(3)) {
+		t.Errorf("Expected EUR delta 3, got %s", diff.SummaryDeltas["EUR"].String())
+	}
+
+	if len(diff.Added) != 1 || diff.Added[0].Currency != "EUR" {
+		t.Errorf("Expected one added EUR fee, got %+v", diff.Added)
+	}
+	if len(diff.Removed) != 0 {
+		t.Errorf("Expected no removed fees, got %+v", diff.Removed)
+	}
+	if len(diff.Changed) != 1 || !diff.Changed[0].Before.Amount.Equal(decimal.NewFromInt(5)) || !diff.Changed[0].After.Amount.Equal(decimal.NewFromInt(7)) {
+		t.Errorf("Expected USD fee changed from 5 to 7, got %+v", diff.Changed)
+	}
+
+	if !DiffResults(a, a).Empty() {
+		t.Error("Expected diff of a result against itself to be empty")
+	}
+}
+
+func TestExecuteResult_NetAmount(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"amount": 1000}})
+	engine.AddRule(`$(amount * 0.03, "USD")`, `amount = 0`, `$(2.0, "EUR")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	net, err := result.NetAmount("amount", "USD")
+	if err != nil {
+		t.Fatalf("NetAmount failed: %v", err)
+	}
+	if !net.Equal(decimal.NewFromInt(970)) {
+		t.Errorf("Expected net amount 970, got %s", net.String())
+	}
+
+	engine = New(&Context{Vars: map[string]interface{}{"amount": 1000}})
+	engine.AddRule(`$(30.0, "USD")`, `$(-5.0, "USD")`)
+
+	result, err = engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	net, err = result.NetAmount("amount", "usd")
+	if err != nil {
+		t.Fatalf("NetAmount failed: %v", err)
+	}
+	if !net.Equal(decimal.NewFromInt(975)) {
+		t.Errorf("Expected discount to add back to net amount 975, got %s", net.String())
+	}
+}
+
+func TestExecuteResult_MeetsMinimum(t *testing.T) {
+	engine := New(nil).SetVar("amount", 1.0)
+	engine.AddRule(`$(0.3, "USD")`, `$(amount * 0.029, "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	ok, shortfall, err := result.MeetsMinimum("USD", decimal.RequireFromString("0.75"))
+	if err != nil {
+		t.Fatalf("MeetsMinimum failed: %v", err)
+	}
+	if ok {
+		t.Errorf("Expected net 0.671 to fall short of 0.75")
+	}
+
+	if !shortfall.Equal(decimal.RequireFromString("0.079")) {
+		t.Errorf("Expected shortfall 0.079, got %s", shortfall.String())
+	}
+
+	ok, shortfall, err = result.MeetsMinimum("USD", decimal.RequireFromString("0.5"))
+	if err != nil {
+		t.Fatalf("MeetsMinimum failed: %v", err)
+	}
+	if !ok || !shortfall.IsZero() {
+		t.Errorf("Expected net 0.671 to meet 0.5, got %v with shortfall %s", ok, shortfall.String())
+	}
+}
+
+func TestExecuteResult_MeetsMinimumMissingBase(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(0.3, "USD")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	_, _, err = result.MeetsMinimum("USD", decimal.RequireFromString("0.75"))
+	var missing *MissingVarError
+	if !errors.As(err, &missing) || missing.Name != "amount" {
+		t.Errorf("Expected MissingVarError for amount, got %v", err)
+	}
+}
+
+func TestNormalizeSummary(t *testing.T) {
+	summary := []FeeItem{
+		{Amount: decimal.NewFromInt(10), Currency: "USD", Tags: map[string]string{"type": "network", "region": "eu"}},
+		{Amount: decimal.NewFromInt(3), Currency: "EUR"},
+		{Amount: decimal.NewFromInt(5), Currency: "USD", Tags: map[string]string{"type": "network"}},
+		{Amount: decimal.NewFromInt(-3), Currency: "EUR"},
+		{Amount: decimal.Zero, Currency: "GBP"},
+	}
+
+	normalized := NormalizeSummary(summary)
+
+	if len(normalized) != 1 {
+		t.Fatalf("Expected a single folded line, got %+v", normalized)
+	}
+	if normalized[0].Currency != "USD" || !normalized[0].Amount.Equal(decimal.NewFromInt(15)) {
+		t.Errorf("Expected 15 USD, got %s %s", normalized[0].Amount.String(), normalized[0].Currency)
+	}
+	if len(normalized[0].Tags) != 1 || normalized[0].Tags["type"] != "network" {
+		t.Errorf("Expected only shared tags to be kept, got %v", normalized[0].Tags)
+	}
+
+	engine := New(nil)
+	engine.AddRule(`[$(5.0, "USD"), $(2.0, "EUR"), $(-2.0, "EUR")]`)
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(result.Summary) != 1 {
+		t.Errorf("Expected zero EUR line to be dropped, got %+v", result.Summary)
+	}
+
+	result, err = engine.Reset().WithZeroSummaryLines(true).Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(result.Summary) != 2 {
+		t.Errorf("Expected zero EUR line to be kept, got %+v", result.Summary)
+	}
+}
+
+func TestAggregateResults(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(amount * 0.01, "USD")`, `amount > 500 ? $(0.1, "EUR") : nil`)
+
+	results, err := engine.ExecuteBatch([]map[string]interface{}{
+		{"amount": 100.0},
+		{"amount": 1000.0},
+		{"amount": 2000.0},
+	})
+	if err != nil {
+		t.Fatalf("ExecuteBatch failed: %v", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 batch results, got %d", len(results))
+	}
+
+	if amount, _ := results[0].Context.getVar("amount"); amount != 100.0 {
+		t.Errorf("Expected first result to keep its own context, got amount %v", amount)
+	}
+
+	aggregate := AggregateResults(results)
+
+	if len(aggregate) != 2 {
+		t.Fatalf("Expected 2 currencies, got %+v", aggregate)
+	}
+	if aggregate[0].Currency != "USD" || !aggregate[0].Amount.Equal(decimal.NewFromInt(31)) {
+		t.Errorf("Expected 31 USD, got %s %s", aggregate[0].Amount.String(), aggregate[0].Currency)
+	}
+	if aggregate[1].Currency != "EUR" || !aggregate[1].Amount.Equal(decimal.RequireFromString("0.2")) {
+		t.Errorf("Expected 0.2 EUR, got %s %s", aggregate[1].Amount.String(), aggregate[1].Currency)
+	}
+}
+
+func TestMarshalResult(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": decimal.RequireFromString("10000.005"),
+			"rate":   0.015,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx).EnableLog()
+	engine.AddRule(`$(Mul(amount, rate), "USD")`, `$(12.5, "EUR")`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	asStrings, err := MarshalResult(result, true)
+	if err != nil {
+		t.Fatalf("MarshalResult failed: %v", err)
+	}
+	if !strings.Contains(string(asStrings), `"amount":"150.000075"`) {
+		t.Errorf("Expected quoted amount, got %s", asStrings)
+	}
+
+	asNumbers, err := MarshalResult(result, false)
+	if err != nil {
+		t.Fatalf("MarshalResult failed: %v", err)
+	}
+	if !strings.Contains(string(asNumbers), `"amount":150.000075`) {
+		t.Errorf("Expected bare number amount, got %s", asNumbers)
+	}
+	if !strings.Contains(string(asNumbers), `"amount":10000.005`) {
+		t.Errorf("Expected decimal var as number, got %s", asNumbers)
+	}
+
+	for _, data := range [][]byte{asStrings, asNumbers} {
+		var decoded ExecuteResult
+		if err := json.Unmarshal(data, &decoded); err != nil {
+			t.Fatalf("Failed to decode result: %v", err)
+		}
+
+		for i, item := range decoded.FeeItems {
+			if !item.Amount.Equal(result.FeeItems[i].Amount) {
+				t.Errorf("Expected fee item %d amount %s, got %s", i, result.FeeItems[i].Amount.String(), item.Amount.String())
+			}
+		}
+		for i, item := range decoded.Logs {
+			if !item.FeeItems[0].Amount.Equal(result.Logs[i].FeeItems[0].Amount) {
+				t.Errorf("Expected log %d amount %s, got %s", i, result.Logs[i].FeeItems[0].Amount.String(), item.FeeItems[0].Amount.String())
+			}
+		}
+		if !findAmountByCurrency(decoded.Summary, "USD").Equal(decimal.RequireFromString("150.000075")) {
+			t.Errorf("Expected USD summary 150.000075, got %s", findAmountByCurrency(decoded.Summary, "USD").String())
+		}
+	}
+}
+
+func TestMarshalResult_LogVars(t *testing.T) {
+	engine := New(&Context{Vars: map[string]interface{}{"amount": decimal.RequireFromString("10.5")}}).EnableLog()
+	engine.AddRule(`fee = Mul(amount, 2)`)
+
+	result, err := engine.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	asNumbers, err := MarshalResult(result, false)
+	if err != nil {
+		t.Fatalf("MarshalResult failed: %v", err)
+	}
+	var decoded struct {
+		Logs []struct {
+			Vars map[string]json.RawMessage `json:"vars"`
+		} `json:"logs"`
+	}
+	if err := json.Unmarshal(asNumbers, &decoded); err != nil {
+		t.Fatalf("Failed to decode result: %v", err)
+	}
+	if len(decoded.Logs) != 1 {
+		t.Fatalf("Expected 1 log, got %d", len(decoded.Logs))
+	}
+	for name, want := range map[string]string{"amount": "10.5", "fee": "21"} {
+		if got := string(decoded.Logs[0].Vars[name]); got != want {
+			t.Errorf("Expected log var %s as number %s, got %s", name, want, got)
+		}
+	}
+}
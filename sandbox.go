@@ -0,0 +1,49 @@
+package feecalc
+
+import "reflect"
+
+// SandboxOptions restricts what rules from semi-trusted sources can do
+type SandboxOptions struct {
+	// AllowedFuncs lists the helper and registered functions rules may call.
+	// $, Set and Return are always available since the rule syntax depends on them.
+	AllowedFuncs []string
+	// AllowBuiltins keeps expr's builtins (map, filter, len, ...) available.
+	// They are disabled by default since they allow unbounded iteration.
+	AllowBuiltins bool
+	// MaxNodes caps the size of a compiled rule; zero keeps expr's default
+	MaxNodes uint
+}
+
+// restrict removes functions that are not allowlisted from env, so rules
+// referencing them fail to compile
+func (s *SandboxOptions) restrict(env map[string]interface{}) {
+	allowed := map[string]bool{"$": true, "Set": true, "Return": true}
+	for _, name := range s.AllowedFuncs {
+		allowed[name] = true
+	}
+	for k, v := range env {
+		if allowed[k] || v == nil {
+			continue
+		}
+		if reflect.TypeOf(v).Kind() == reflect.Func {
+			delete(env, k)
+		}
+	}
+}
+
+// WithSandbox limits rules to the allowlisted functions and disables expr
+// builtins unless allowed. Rules referencing anything else fail to compile.
+func (e *FeeEngine) WithSandbox(opts SandboxOptions) *FeeEngine {
+	e.opts.sandbox = &opts
+	return e
+}
+
+// RegisterFunc makes a Go function callable from rules under the given name.
+// Built-in helpers such as $ and Mul cannot be overridden.
+func (e *FeeEngine) RegisterFunc(name string, fn interface{}) *FeeEngine {
+	if e.opts.funcs == nil {
+		e.opts.funcs = make(map[string]interface{})
+	}
+	e.opts.funcs[name] = fn
+	return e
+}
@@ -0,0 +1,52 @@
+package feecalc
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestSandbox_RejectsUnlistedFunc(t *testing.T) {
+	surcharge := func(amount float64) float64 {
+		return amount * 0.1
+	}
+	rule := `$(surcharge(amount), "USD")`
+
+	newEngine := func() *FeeEngine {
+		ctx := &Context{
+			Vars: map[string]interface{}{
+				"amount": 100.0,
+			},
+			FeeItems: make([]FeeItem, 0),
+		}
+		return New(ctx).RegisterFunc("surcharge", surcharge).AddRule(rule)
+	}
+
+	result, err := newEngine().Execute()
+	if err != nil {
+		t.Fatalf("Execute failed without sandbox: %v", err)
+	}
+	if !result.FeeItems[0].Amount.Equal(decimal.NewFromInt(10)) {
+		t.Errorf("Expected fee 10, got %s", result.FeeItems[0].Amount.String())
+	}
+
+	_, err = newEngine().WithSandbox(SandboxOptions{AllowedFuncs: []string{"Mul"}}).Execute()
+	var ce *CompileError
+	if !errors.As(err, &ce) {
+		t.Fatalf("Expected CompileError in sandbox mode, got %v", err)
+	}
+
+	if _, err := newEngine().WithSandbox(SandboxOptions{AllowedFuncs: []string{"surcharge"}}).Execute(); err != nil {
+		t.Errorf("Expected allowlisted function to run in sandbox mode, got %v", err)
+	}
+}
+
+func TestSandbox_DisablesBuiltins(t *testing.T) {
+	engine := New(nil).WithSandbox(SandboxOptions{})
+	engine.AddRule(`$(len(filter(1..1000, # > 0)), "USD")`)
+
+	if _, err := engine.Execute(); err == nil {
+		t.Fatal("Expected builtins to be rejected in sandbox mode, but got nil")
+	}
+}
@@ -0,0 +1,149 @@
+package feecalc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// SweepPoint is the outcome of one Sweep run
+type SweepPoint struct {
+	Value    interface{}     `json:"value"`
+	Currency Currency        `json:"currency"`
+	Total    decimal.Decimal `json:"total"`
+}
+
+// Sweep runs Reset().SetVar(varName, v).Execute() for each value and reports
+// the primary currency total of each run. The primary currency is the default
+// currency if configured, otherwise the first currency in the summary.
+// The engine is left in the state of the last run.
+func (e *FeeEngine) Sweep(varName string, values []interface{}) ([]SweepPoint, error) {
+	points := make([]SweepPoint, 0, len(values))
+	for _, v := range values {
+		result, err := e.Reset().SetVar(varName, v).Execute()
+		if err != nil {
+			return nil, fmt.Errorf("sweep %s=%v: %w", varName, v, err)
+		}
+		point := SweepPoint{Value: v, Total: decimal.Zero}
+		if e.opts.defaultCurrency != "" {
+			point.Currency = normalizeCurrency(e.opts.defaultCurrency)
+		} else if len(result.Summary) > 0 {
+			point.Currency = result.Summary[0].Currency
+		}
+		for _, item := range result.Summary {
+			if item.Currency == point.Currency {
+				point.Total = item.Amount
+			}
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+// solveTolerance is the change in base amount below which SolveInclusive
+// considers the iteration converged
+var solveTolerance = decimal.New(1, -8)
+
+// SolveResult is the outcome of SolveInclusive
+type SolveResult struct {
+	// Base is the base amount such that Base + Fee equals the gross amount
+	Base decimal.Decimal `json:"base"`
+	// Fee is the currency total charged on Base
+	Fee        decimal.Decimal `json:"fee"`
+	Iterations int             `json:"iterations"`
+	Converged  bool            `json:"converged"`
+}
+
+// SolveInclusive finds the base amount that, together with the fees charged on
+// it in currency, adds up to gross, e.g. to quote a fee-inclusive price. It
+// iterates base = gross - fee(base) on the base var (see WithBaseVar), set as
+// a decimal.Decimal, for at most maxIter runs. If ctx is done before converging, the best result so far
+// is returned with Converged false and a nil error.
+// The engine is left in the state of the last run.
+func (e *FeeEngine) SolveInclusive(ctx context.Context, gross decimal.Decimal, currency string, maxIter int) (SolveResult, error) {
+	if maxIter <= 0 {
+		return SolveResult{}, ErrInvalidCount
+	}
+
+	target := normalizeCurrency(currency)
+	best := SolveResult{Base: gross, Fee: decimal.Zero}
+	for best.Iterations < maxIter {
+		if ctx.Err() != nil {
+			return best, nil
+		}
+
+		e.Reset().SetVarDecimal(e.opts.base(), best.Base)
+		result, err := e.ExecuteContext(ctx)
+		if err != nil {
+			if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+				return best, nil
+			}
+			return best, fmt.Errorf("solve inclusive at base %s: %w", best.Base.String(), err)
+		}
+
+		fee := decimal.Zero
+		for _, item := range result.Summary {
+			if item.Currency == target {
+				fee = item.Amount
+			}
+		}
+		next := gross.Sub(fee)
+		best.Fee = fee
+		best.Iterations++
+		if next.Sub(best.Base).Abs().LessThanOrEqual(solveTolerance) {
+			best.Converged = true
+			return best, nil
+		}
+		best.Base = next
+	}
+	return best, nil
+}
+
+// breakEvenMaxSteps bounds the bisection in BreakEven
+const breakEvenMaxSteps = 200
+
+// BreakEven bisects varName over [lo, hi] for the smallest value at which
+// predicate holds, e.g. where a percentage fee overtakes a fixed one. The
+// predicate must be monotonic: false below the boundary and true from it on.
+// Each step runs Reset().SetVarDecimal(varName, v).Execute(), so rules see v
+// as an exact decimal.Decimal, and the boundary is located to within 1e-8. ok is false when the predicate
+// does not hold at hi or a run fails.
+// The engine is left in the state of the last run.
+func (e *FeeEngine) BreakEven(varName string, lo, hi decimal.Decimal, predicate func(*ExecuteResult) bool) (decimal.Decimal, bool) {
+	holds := func(v decimal.Decimal) (bool, bool) {
+		result, err := e.Reset().SetVarDecimal(varName, v).Execute()
+		if err != nil {
+			return false, false
+		}
+		return predicate(result), true
+	}
+
+	if lo.GreaterThan(hi) {
+		return decimal.Zero, false
+	}
+	if ok, ran := holds(hi); !ok || !ran {
+		return decimal.Zero, false
+	}
+	if ok, ran := holds(lo); !ran {
+		return decimal.Zero, false
+	} else if ok {
+		return lo, true
+	}
+
+	two := decimal.NewFromInt(2)
+	for step := 0; step < breakEvenMaxSteps && hi.Sub(lo).GreaterThan(solveTolerance); step++ {
+		mid := lo.Add(hi).Div(two)
+		ok, ran := holds(mid)
+		if !ran {
+			return decimal.Zero, false
+		}
+		if ok {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi, true
+}
@@ -0,0 +1,128 @@
+package feecalc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestSolver_Sweep(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 0.0,
+		},
+		FeeItems: make([]FeeItem, 0),
+	}
+	engine := New(ctx)
+	engine.AddRule(`$(amount * 0.01, "USD")`, `$(2.0, "USD")`, `$(1.0, "EUR")`)
+
+	points, err := engine.Sweep("amount", []interface{}{1000.0, 5000.0, 10000.0})
+	if err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+
+	if len(points) != 3 {
+		t.Fatalf("Expected 3 sweep points, got %d", len(points))
+	}
+
+	expected := []int64{12, 52, 102}
+	for i, want := range expected {
+		if points[i].Currency != "USD" {
+			t.Errorf("Expected primary currency USD, got %s", points[i].Currency)
+		}
+		if !points[i].Total.Equal(decimal.NewFromInt(want)) {
+			t.Errorf("Expected total %d at point %d, got %s", want, i, points[i].Total.String())
+		}
+		if i > 0 && !points[i].Total.GreaterThan(points[i-1].Total) {
+			t.Errorf("Expected totals to increase, got %s after %s", points[i].Total.String(), points[i-1].Total.String())
+		}
+	}
+}
+
+func TestSolver_SolveInclusive(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(amount * 0.02, "USD")`, `$(1.0, "USD")`)
+
+	res, err := engine.SolveInclusive(context.Background(), decimal.NewFromInt(103), "USD", 50)
+	if err != nil {
+		t.Fatalf("SolveInclusive failed: %v", err)
+	}
+
+	if !res.Converged {
+		t.Fatalf("Expected solver to converge, got %+v", res)
+	}
+
+	if !res.Base.Round(4).Equal(decimal.NewFromInt(100)) {
+		t.Errorf("Expected base 100, got %s", res.Base.String())
+	}
+
+	if !res.Base.Add(res.Fee).Round(4).Equal(decimal.NewFromInt(103)) {
+		t.Errorf("Expected base + fee to equal 103, got %s", res.Base.Add(res.Fee).String())
+	}
+}
+
+func TestSolver_SolveInclusiveDecimalBase(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(amount * 0.5, "USD")`)
+
+	res, err := engine.SolveInclusive(context.Background(), decimal.RequireFromString("1234567.123456789"), "USD", 100)
+	if err != nil {
+		t.Fatalf("SolveInclusive failed: %v", err)
+	}
+
+	if amount, _ := engine.GetVar("amount"); !isDecimal(amount) {
+		t.Fatalf("Expected the base var to be a decimal, got %T", amount)
+	}
+	if want := res.Base.Mul(decimal.RequireFromString("0.5")); !res.Fee.Equal(want) {
+		t.Errorf("Expected fee %s to be exactly half of base %s", res.Fee.String(), res.Base.String())
+	}
+}
+
+func TestSolver_SolveInclusiveDeadline(t *testing.T) {
+	engine := New(nil)
+	engine.AddRule(`$(amount * 0.02, "USD")`, `$(1.0, "USD")`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+
+	res, err := engine.SolveInclusive(ctx, decimal.NewFromInt(103), "USD", 50)
+	if err != nil {
+		t.Fatalf("Expected graceful return on deadline, got %v", err)
+	}
+
+	if res.Converged {
+		t.Error("Expected non-convergent result after deadline")
+	}
+
+	if !res.Base.Equal(decimal.NewFromInt(103)) {
+		t.Errorf("Expected best-so-far base 103, got %s", res.Base.String())
+	}
+}
+
+func TestSolver_BreakEven(t *testing.T) {
+	// 1.5% fee with a 3 USD minimum: the percentage takes over at 200
+	engine := New(nil)
+	engine.AddRule(`$(PctOrFixed(amount, 0.015, 3), "USD")`)
+
+	over := func(r *ExecuteResult) bool {
+		if amount, _ := engine.GetVar("amount"); !isDecimal(amount) {
+			t.Fatalf("Expected the bisected var to be a decimal, got %T", amount)
+		}
+		return findAmountByCurrency(r.Summary, "USD").GreaterThan(decimal.NewFromInt(3))
+	}
+	boundary, ok := engine.BreakEven("amount", decimal.Zero, decimal.NewFromInt(10000), over)
+	if !ok {
+		t.Fatalf("Expected a break-even amount")
+	}
+
+	if boundary.Sub(decimal.NewFromInt(200)).Abs().GreaterThan(decimal.New(1, -6)) {
+		t.Errorf("Expected break-even near 200, got %s", boundary.String())
+	}
+
+	if _, ok := engine.BreakEven("amount", decimal.Zero, decimal.NewFromInt(100), over); ok {
+		t.Errorf("Expected no break-even below 100")
+	}
+}
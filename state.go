@@ -0,0 +1,169 @@
+package feecalc
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// stateVersion is bumped whenever the SaveState format changes incompatibly.
+// Version 2 keeps decimals in the reset vars.
+const stateVersion = 2
+
+// engineState is the serialized form of an engine's rules and context
+type engineState struct {
+	Version     int                   `json:"version"`
+	Rules       []ruleState           `json:"rules"`
+	Cursor      int                   `json:"cursor"`
+	Halted      bool                  `json:"halted,omitempty"`
+	Iteration   int                   `json:"iteration,omitempty"`
+	EnableLog   bool                  `json:"enable_log,omitempty"`
+	ResetVars   map[string]stateValue `json:"reset_vars,omitempty"`
+	InitialVars map[string]stateValue `json:"initial_vars,omitempty"`
+	Vars        map[string]stateValue `json:"vars"`
+	FeeItems    []FeeItem             `json:"fee_items"`
+	Logs        []logState            `json:"logs,omitempty"`
+	Warnings    []string              `json:"warnings,omitempty"`
+	TxID        string                `json:"tx_id,omitempty"`
+}
+
+type ruleState struct {
+	Expr  string   `json:"expr"`
+	Name  string   `json:"name,omitempty"`
+	Final bool     `json:"final,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	// EnableIf is the rule's AddRuleIf condition
+	EnableIf string `json:"enable_if,omitempty"`
+}
+
+type logState struct {
+	logFields
+	Vars map[string]stateValue `json:"vars,omitempty"`
+}
+
+// stateValue keeps decimal vars as decimals across a save and restore; other
+// values round-trip through plain JSON, so numbers come back as float64
+type stateValue struct {
+	Decimal *decimal.Decimal `json:"decimal,omitempty"`
+	Value   interface{}      `json:"value,omitempty"`
+}
+
+func encodeStateVars(vars map[string]interface{}) map[string]stateValue {
+	if vars == nil {
+		return nil
+	}
+	out := make(map[string]stateValue, len(vars))
+	for k, v := range vars {
+		switch d := v.(type) {
+		case decimal.Decimal:
+			out[k] = stateValue{Decimal: &d}
+		case *decimal.Decimal:
+			out[k] = stateValue{Decimal: d}
+		default:
+			out[k] = stateValue{Value: v}
+		}
+	}
+	return out
+}
+
+func decodeStateVars(vars map[string]stateValue) map[string]interface{} {
+	if vars == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(vars))
+	for k, v := range vars {
+		if v.Decimal != nil {
+			out[k] = *v.Decimal
+		} else {
+			out[k] = v.Value
+		}
+	}
+	return out
+}
+
+// SaveState serializes the engine's rules and execution state (position, vars,
+// fee items, logs and warnings) so a partially executed engine can be resumed
+// with RestoreState, e.g. in another process. Options set with the With*
+// methods and registered functions are not saved.
+func (e *FeeEngine) SaveState() ([]byte, error) {
+	e.ctx.mu.RLock()
+	defer e.ctx.mu.RUnlock()
+
+	state := engineState{
+		Version:     stateVersion,
+		Rules:       make([]ruleState, len(e.rules)),
+		Cursor:      e.ctx.lastExecutedRule,
+		Halted:      e.ctx.halted,
+		Iteration:   e.ctx.iteration,
+		EnableLog:   e.ctx.enableLog,
+		ResetVars:   encodeStateVars(e.ctx.resetVars),
+		InitialVars: encodeStateVars(e.ctx.initialVars),
+		Vars:        encodeStateVars(e.ctx.Vars),
+		FeeItems:    e.ctx.FeeItems,
+		Warnings:    e.ctx.Warnings,
+		TxID:        e.ctx.TxID,
+	}
+	for i, r := range e.rules {
+		state.Rules[i] = ruleState{Expr: r.expr, Name: r.name, Final: r.final, Tags: r.tags, EnableIf: r.enableIf}
+	}
+	for _, l := range e.ctx.Logs {
+		state.Logs = append(state.Logs, logState{logFields: logFields(l), Vars: encodeStateVars(l.Vars)})
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save engine state: %w", err)
+	}
+	return data, nil
+}
+
+// RestoreState builds an engine from data produced by SaveState. Execute on
+// the restored engine continues where the saved engine left off. Options and
+// registered functions must be applied again.
+func RestoreState(data []byte) (*FeeEngine, error) {
+	var state engineState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to restore engine state: %w", err)
+	}
+	if state.Version != stateVersion {
+		return nil, fmt.Errorf("unsupported engine state version %d", state.Version)
+	}
+	if state.Cursor < 0 || state.Cursor > len(state.Rules) {
+		return nil, fmt.Errorf("invalid engine state cursor %d for %d rules", state.Cursor, len(state.Rules))
+	}
+
+	ctx := &Context{
+		resetVars:        decodeStateVars(state.ResetVars),
+		Vars:             decodeStateVars(state.Vars),
+		FeeItems:         state.FeeItems,
+		Logs:             make([]Log, 0, len(state.Logs)),
+		Warnings:         state.Warnings,
+		enableLog:        state.EnableLog,
+		lastExecutedRule: state.Cursor,
+		initialVars:      decodeStateVars(state.InitialVars),
+		halted:           state.Halted,
+		iteration:        state.Iteration,
+		TxID:             state.TxID,
+	}
+	if ctx.Vars == nil {
+		ctx.Vars = make(map[string]interface{})
+	}
+	if ctx.FeeItems == nil {
+		ctx.FeeItems = make([]FeeItem, 0)
+	}
+	for _, l := range state.Logs {
+		entry := Log(l.logFields)
+		entry.Vars = decodeStateVars(l.Vars)
+		ctx.Logs = append(ctx.Logs, entry)
+	}
+
+	e := &FeeEngine{
+		ctx:   ctx,
+		rules: make([]rule, len(state.Rules)),
+	}
+	for i, r := range state.Rules {
+		e.rules[i] = rule{expr: r.Expr, name: r.Name, final: r.Final, tags: r.Tags, enableIf: r.EnableIf}
+	}
+	return e, nil
+}
@@ -0,0 +1,63 @@
+package feecalc
+
+import (
+	"testing"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestState_SaveAndRestore(t *testing.T) {
+	ctx := &Context{
+		Vars: map[string]interface{}{
+			"amount": 1000.0,
+		},
+	}
+	engine := New(ctx).EnableLog()
+	engine.SetVarDecimal("fixed", decimal.RequireFromString("0.1"))
+	engine.AddRule(
+		`$(amount * 0.01, "USD")`,
+		`amount = amount - 10`,
+		`$(amount * 0.02, "USD")`,
+		`$(Add(fixed, 0.2), "EUR")`,
+	)
+
+	if _, err := engine.ExecuteN(2); err != nil {
+		t.Fatalf("ExecuteN failed: %v", err)
+	}
+
+	data, err := engine.SaveState()
+	if err != nil {
+		t.Fatalf("SaveState failed: %v", err)
+	}
+
+	restored, err := RestoreState(data)
+	if err != nil {
+		t.Fatalf("RestoreState failed: %v", err)
+	}
+
+	result, err := restored.Execute()
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+
+	if result.ProcessedRules != 2 {
+		t.Errorf("Expected the remaining 2 rules to run, got %d", result.ProcessedRules)
+	}
+
+	// 10 + (1000 - 10) * 0.02
+	if total := findAmountByCurrency(result.Summary, "USD"); !total.Equal(decimal.RequireFromString("29.8")) {
+		t.Errorf("Expected USD total 29.8, got %s", total.String())
+	}
+
+	if total := findAmountByCurrency(result.Summary, "EUR"); !total.Equal(decimal.RequireFromString("0.3")) {
+		t.Errorf("Expected EUR total 0.3, got %s", total.String())
+	}
+
+	if len(result.Logs) != 4 {
+		t.Errorf("Expected 4 log entries across both runs, got %d", len(result.Logs))
+	}
+
+	if _, err := RestoreState([]byte(`{"version": 99}`)); err == nil {
+		t.Error("Expected error for unsupported state version, but got nil")
+	}
+}
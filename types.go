@@ -1,44 +1,143 @@
 package feecalc
 
 import (
+	"io"
 	"sync"
 
 	"github.com/shopspring/decimal"
 )
 
 type Log struct {
-	Rule     string                 `json:"rule"`
+	Rule string `json:"rule"`
+	// Preprocessed is the rule as evaluated, set when it differs from Rule
+	// (e.g. assignments rewritten to Set calls)
+	Preprocessed string `json:"preprocessed,omitempty"`
+	// Vars snapshots the vars after the rule; see Log.MarshalJSON for how
+	// decimals serialize
 	Vars     map[string]interface{} `json:"vars"`
 	FeeItems []FeeItem              `json:"fee_items"`
+	// TxID is the context's transaction ID when the entry was recorded
+	TxID string `json:"tx_id,omitempty"`
 }
 
 // Context holds variables and fee items during calculation
 type Context struct {
 	mu               sync.RWMutex
-	ctxJson          []byte                 `json: "-"`
 	Vars             map[string]interface{} `json:"vars"`
 	FeeItems         []FeeItem              `json:"fee_items"`
 	Logs             []Log                  `json:"logs"`
+	Warnings         []string               `json:"warnings,omitempty"`
+	TxID             string                 `json:"tx_id,omitempty"`
 	enableLog        bool
 	lastExecutedRule int
+	// resetVars holds the vars the context was created with; Reset restores them
+	resetVars map[string]interface{}
+	// initialVars snapshots the vars when execution starts at the first rule
+	initialVars map[string]interface{}
+	// callVars snapshots the vars when the current Execute call starts
+	callVars map[string]interface{}
+	// halted is set once a final rule has run; no further rules execute
+	halted bool
+	// iteration counts ResetKeepLogs calls since the last Reset
+	iteration int
 }
 
 // FeeItem represents a fee with amount and currency
 type FeeItem struct {
-	Amount   decimal.Decimal `json:"amount"`
-	Currency string          `json:"currency"`
+	Amount   decimal.Decimal   `json:"amount"`
+	Currency Currency          `json:"currency"`
+	Label    string            `json:"label,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+	// Bucket groups fee items for SummaryByBucket, e.g. a tax jurisdiction
+	Bucket string `json:"bucket,omitempty"`
 }
 
 // RuleResult represents the result of executing a fee rule
 type RuleResult struct {
 	FeeItems []FeeItem `json:"fee_items,omitempty"`
 	Context  *Context  `json:"context,omitempty"`
+	Warnings []string  `json:"warnings,omitempty"`
+	// Halt is set when the rule called Stop()
+	Halt bool `json:"halt,omitempty"`
+}
+
+// LogLevel controls how much detail each log entry records
+type LogLevel int
+
+const (
+	// LogLevelFull records the rule, its fee items and a snapshot of all vars
+	LogLevelFull LogLevel = iota
+	// LogLevelMinimal records only the rule and its fee items
+	LogLevelMinimal
+)
+
+// RoundingMode selects how the Round and Quantize helpers round
+type RoundingMode int
+
+const (
+	// RoundHalfUp rounds halves away from zero
+	RoundHalfUp RoundingMode = iota
+	// RoundHalfEven rounds halves to the nearest even digit (banker's rounding)
+	RoundHalfEven
+	// RoundDown rounds towards zero
+	RoundDown
+	// RoundUp rounds away from zero
+	RoundUp
+	// RoundCeiling rounds towards positive infinity
+	RoundCeiling
+	// RoundFloor rounds towards negative infinity
+	RoundFloor
+)
+
+// rule is a fee rule expression with optional metadata
+type rule struct {
+	expr  string
+	name  string
+	final bool
+	tags  []string
+	// enableIf is a condition on the constants deciding whether the rule runs
+	enableIf string
 }
 
 // FeeEngine executes fee calculation rules
 type FeeEngine struct {
-	ctx   *Context
-	rules []string
+	ctx       *Context
+	rules     []rule
+	logWriter io.Writer
+	logLevel  LogLevel
+
+	expectedCurrencies map[Currency]bool
+	allowEmptyRules    bool
+	rounding           bool
+	roundPlaces        int32
+	allocateResidual   bool
+	interceptor        func(FeeItem) (FeeItem, error)
+	keepReverseSign    bool
+	summaryTags        bool
+	seed               int64
+	seeded             bool
+	maxFeeItems        int
+	currencyTable      map[Currency]CurrencyInfo
+	currencyRounding   bool
+	keepZeroSummary    bool
+	summaryMultiplier  *decimal.Decimal
+	dropZeroFees       bool
+	guardDoubleExecute bool
+	// stream receives fee items instead of the context during ExecuteStream
+	stream func(FeeItem) error
+
+	profiler profiler
+	opts     exprOptions
+}
+
+// Overrides replaces configured values for a single ExecuteWith run
+type Overrides struct {
+	// Vars are set on top of the context's vars
+	Vars map[string]interface{}
+	// Constants are merged over the engine's constants
+	Constants map[string]interface{}
+	// Rates replace the engine's rates for the same currency pair
+	Rates []Rate
 }
 
 // ExecuteResult represents the result of executing rules
@@ -48,4 +147,13 @@ type ExecuteResult struct {
 	FeeItems       []FeeItem `json:"fee_items"`
 	Summary        []FeeItem `json:"summary"`
 	Context        *Context  `json:"context"`
+	Warnings       []string  `json:"warnings,omitempty"`
+	// Halted reports that execution stopped for good, e.g. after a final rule
+	Halted bool `json:"halted,omitempty"`
+	// TxID is the context's transaction ID, see WithTxID
+	TxID string `json:"tx_id,omitempty"`
+
+	rates      rateTable
+	currencies map[Currency]CurrencyInfo
+	baseVar    string
 }